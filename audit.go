@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// A file sent to the hosts by an audited operation.
+type auditFile struct {
+	Path   string `json:"path"`
+	Dest   string `json:"dest,omitempty"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// One audit log record. Hash is the sha256 of Prev and the record's json encoding with
+// Hash empty, so changing or removing any record breaks the chain after it.
+type auditRecord struct {
+	Seq      int64       `json:"seq"`
+	Time     time.Time   `json:"time"`
+	Operator string      `json:"operator"`
+	Hosts    []string    `json:"hosts"`
+	Op       string      `json:"op"`
+	Endpoint string      `json:"endpoint,omitempty"`
+	Command  string      `json:"command,omitempty"`
+	Files    []auditFile `json:"files,omitempty"`
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Prev     string      `json:"prev"`
+	Hash     string      `json:"hash"`
+}
+
+// Audit log file, empty to disable auditing.
+var auditFileName string
+
+// Serializes appends within the process; lockFile does across processes.
+var auditMu sync.Mutex
+
+// Returns the default audit log, next to the config file.
+func defaultAuditFile() string {
+	return filepath.Join(filepath.Dir(defaultConfigFile()), "audit.jsonl")
+}
+
+// Returns the operator recorded in the audit log: N1_OPERATOR, or user@machine.
+func auditOperator() string {
+	if op := os.Getenv("N1_OPERATOR"); op != "" {
+		return op
+	}
+
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	machine, _ := os.Hostname()
+	return name + "@" + machine
+}
+
+func (r auditRecord) computeHash() string {
+	r.Hash = ""
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(append([]byte(r.Prev), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Read all records of the audit log.
+func readAudit(file string) ([]auditRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+	records := []auditRecord{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+
+		var r auditRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return records, fmt.Errorf("Invalid audit record at line %d: %v", line, err)
+		}
+
+		records = append(records, r)
+	}
+
+	return records, sc.Err()
+}
+
+// Returns the last record of the audit log, reading only the file's tail.
+func lastAuditRecord(f *os.File) (*auditRecord, error) {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return nil, err
+	}
+
+	size := int64(64 * 1024)
+	for {
+		if size > fi.Size() {
+			size = fi.Size()
+		}
+
+		buf := make([]byte, size)
+		if _, err := f.ReadAt(buf, fi.Size()-size); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+		if len(lines) > 1 || size == fi.Size() {
+			var r auditRecord
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &r); err != nil {
+				return nil, fmt.Errorf("Invalid last audit record: %v", err)
+			}
+
+			return &r, nil
+		}
+
+		size *= 4
+	}
+}
+
+// Append 'r' to the audit log, chained to the last record. The file stays locked from
+// reading the last record until the append, so concurrent n1 processes keep the chain
+// intact. Failures are logged but never fail the audited operation.
+func audit(r auditRecord) {
+	if auditFileName == "" {
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(auditFileName), 0755); err != nil {
+		errorln("Audit log:", err)
+		return
+	}
+
+	f, err := os.OpenFile(auditFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		errorln("Audit log:", err)
+		return
+	}
+
+	defer f.Close()
+	unlock, err := lockFile(f)
+	if err != nil {
+		errorln("Audit log:", err)
+		return
+	}
+
+	defer unlock()
+	last, err := lastAuditRecord(f)
+	if err != nil {
+		errorln("Audit log:", err)
+		return
+	}
+
+	if last != nil {
+		r.Seq, r.Prev = last.Seq+1, last.Hash
+	} else {
+		r.Seq = 1
+	}
+
+	r.Time = time.Now().UTC()
+	r.Operator = auditOperator()
+	r.Hash = r.computeHash()
+	b, _ := json.Marshal(r)
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		errorln("Audit log:", err)
+	}
+}
+
+// Returns the digest of a local file sent to 'dest' for the audit log.
+func auditFileDigest(file, dest string) auditFile {
+	af := auditFile{Path: file, Dest: dest}
+	if fi, err := os.Stat(file); err == nil {
+		af.Size = fi.Size()
+	}
+
+	af.Sha256, _ = fileHash(file)
+	return af
+}
+
+// Record a request to 'rawurl' sending 'files'. The operation is named after the
+// endpoint, e.g. "update-self" for /api/v1/update/self.
+func auditRequest(rawurl string, files []auditFile, status string, err error) {
+	r := auditRecord{Endpoint: rawurl, Files: files, Status: status}
+	if u, perr := url.Parse(rawurl); perr == nil {
+		r.Hosts = []string{u.Hostname()}
+		r.Endpoint = u.RequestURI()
+		r.Op = strings.Replace(strings.TrimPrefix(u.Path, "/api/v1/"), "/", "-", -1)
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	audit(r)
+}
+
+// Record a command executed in 'host'.
+func auditExec(op, host, cmd, status string, err error) {
+	r := auditRecord{Op: op, Hosts: []string{host}, Endpoint: "/api/v1/exec", Command: cmd, Status: status}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	audit(r)
+}
+
+// Record operation 'op' in 'host' described by 'detail'.
+func auditOp(op, host, detail string, err error) {
+	r := auditRecord{Op: op, Hosts: []string{host}, Command: detail, Status: "ok"}
+	if err != nil {
+		r.Status, r.Error = "failed", err.Error()
+	}
+
+	audit(r)
+}
+
+// Check the hash chain of the audit log. Returns the number of records checked.
+func verifyAudit(file string) (int, error) {
+	records, err := readAudit(file)
+	if err != nil {
+		return len(records), err
+	}
+
+	prev := ""
+	for i, r := range records {
+		if r.Seq != int64(i+1) {
+			return i, fmt.Errorf("Record %d: expected sequence %d, found %d.", i+1, i+1, r.Seq)
+		}
+
+		if r.Prev != prev {
+			return i, fmt.Errorf("Record %d: chain broken, previous hash doesn't match.", r.Seq)
+		}
+
+		if r.computeHash() != r.Hash {
+			return i, fmt.Errorf("Record %d: hash mismatch, record was modified.", r.Seq)
+		}
+
+		prev = r.Hash
+	}
+
+	return len(records), nil
+}
+
+func auditCommand() cli.Command {
+	return cli.Command{
+		Name:  "audit",
+		Usage: "query and verify the audit log of mutating operations",
+		Subcommands: []cli.Command{
+			{
+				Name:  "log",
+				Usage: "print audit records",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "host",
+						Value: "",
+						Usage: "only records for `host`",
+					},
+					cli.StringFlag{
+						Name:  "op",
+						Value: "",
+						Usage: "only records of `operation`, e.g. exec or update-self",
+					},
+					cli.StringFlag{
+						Name:  "operator",
+						Value: "",
+						Usage: "only records by `operator`",
+					},
+					cli.DurationFlag{
+						Name:  "since",
+						Usage: "only records younger than `duration`",
+					},
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "print records as json lines",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					records, err := readAudit(auditFileName)
+					if err != nil {
+						errorln(err)
+						return err
+					}
+
+					tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+					if !c.Bool("json") {
+						fmt.Fprintln(tw, "SEQ\tTIME\tOPERATOR\tHOSTS\tOP\tSTATUS\tDETAIL")
+					}
+
+					for _, r := range records {
+						if c.String("host") != "" && !containsString(r.Hosts, c.String("host")) {
+							continue
+						}
+
+						if (c.String("op") != "" && r.Op != c.String("op")) ||
+							(c.String("operator") != "" && r.Operator != c.String("operator")) ||
+							(c.Duration("since") > 0 && time.Since(r.Time) > c.Duration("since")) {
+							continue
+						}
+
+						if c.Bool("json") {
+							b, _ := json.Marshal(r)
+							fmt.Println(string(b))
+							continue
+						}
+
+						detail := r.Command
+						if detail == "" {
+							detail = r.Endpoint
+						}
+
+						for _, f := range r.Files {
+							sum := f.Sha256
+							if len(sum) > 12 {
+								sum = sum[:12]
+							}
+
+							detail += " " + f.Path + "@" + sum
+						}
+
+						status := r.Status
+						if r.Error != "" {
+							status = r.Error
+						}
+
+						fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Seq, r.Time.Local().Format("2006-01-02 15:04:05"),
+							r.Operator, strings.Join(r.Hosts, ","), r.Op, status, detail)
+					}
+
+					return tw.Flush()
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "check the hash chain of the audit log",
+				Action: func(c *cli.Context) error {
+					n, err := verifyAudit(auditFileName)
+					if err != nil {
+						errorln(err)
+						return err
+					}
+
+					fmt.Printf("%s: %d record(s) ok\n", auditFileName, n)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// Returns true if 'list' contains 'v'.
+func containsString(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
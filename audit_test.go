@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestVerifyAudit(t *testing.T) {
+	saved := auditFileName
+	defer func() { auditFileName = saved }()
+
+	auditFileName = filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 3; i++ {
+		auditExec("exec", fmt.Sprintf("h%d", i), "hostname", "200 OK", nil)
+	}
+
+	if n, err := verifyAudit(auditFileName); err != nil || n != 3 {
+		t.Fatalf("verifyAudit = %d, %v, want 3 records ok", n, err)
+	}
+
+	b, err := ioutil.ReadFile(auditFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	for _, tt := range []struct {
+		name string
+		log  string
+		want string
+	}{
+		{"modified", lines[0] + strings.Replace(lines[1], "hostname", "reboot", 1) + lines[2], "modified"},
+		{"removed", lines[0] + lines[2], "sequence"},
+		{"truncated head", lines[1] + lines[2], "sequence"},
+	} {
+		file := filepath.Join(t.TempDir(), "audit.jsonl")
+		if err := ioutil.WriteFile(file, []byte(tt.log), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := verifyAudit(file); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: verifyAudit error = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Appends records to N1_AUDIT_HELPER when run as a child of TestAuditConcurrentProcesses.
+func TestAuditHelper(t *testing.T) {
+	file := os.Getenv("N1_AUDIT_HELPER")
+	if file == "" {
+		t.Skip("only run as a helper process")
+	}
+
+	saved := auditFileName
+	defer func() { auditFileName = saved }()
+
+	auditFileName = file
+	for i := 0; i < 100; i++ {
+		auditOp("test", "h1", fmt.Sprint(i), nil)
+	}
+}
+
+func TestAuditConcurrentProcesses(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestAuditHelper$")
+			cmd.Env = append(os.Environ(), "N1_AUDIT_HELPER="+file)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("helper failed: %v\n%s", err, out)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if n, err := verifyAudit(file); err != nil || n != 400 {
+		t.Fatalf("verifyAudit = %d, %v, want 400 records ok", n, err)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Locks older than this were left behind by a crashed n1 and are taken over.
+const staleLockAge = 10 * time.Second
+
+// Take an exclusive lock on 'f' by creating '<f>.lock', shared with other n1 processes.
+// Call the returned function to release it.
+func lockFile(f *os.File) (func(), error) {
+	name := f.Name() + ".lock"
+	deadline := time.Now().Add(staleLockAge)
+	for {
+		l, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			l.Close()
+			return func() { os.Remove(name) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			os.Remove(name)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for lock %s.", name)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Settings of the shared http client, set from the global flags.
+type clientSettings struct {
+	timeout        time.Duration
+	connectTimeout time.Duration
+	retries        int
+	backoff        time.Duration
+	retryMutating  bool
+	maxConns       int
+	compress       bool
+	proxy          string
+	inventory      string
+	debugHttp      bool
+	debugBodyLimit int
+	harFile        string
+	dryRun         bool
+}
+
+var settings = clientSettings{
+	connectTimeout: 10 * time.Second,
+	retries:        3,
+	backoff:        500 * time.Millisecond,
+	maxConns:       8,
+	debugBodyLimit: 4096,
+}
+
+// Shared http client used for all requests to holly.
+var httpClient = newHttpClient()
+
+// Retry delays are capped at this value.
+const maxBackoff = 30 * time.Second
+
+// Upper bound of the overall timeout of quick read-only requests, even with --timeout 0.
+const quickTimeout = 30 * time.Second
+
+// Holly endpoints that always answer right away, see quickTimeout.
+var quickPaths = map[string]bool{
+	"/api/v1/version":  true,
+	"/api/v1/filestat": true,
+}
+
+// Request bodies smaller than this are never compressed.
+const minCompressSize = 1024
+
+// Holly endpoints that are safe to retry on any failure.
+var idempotentPaths = map[string]bool{
+	"/api/v1/version":  true,
+	"/api/v1/filestat": true,
+	"/api/v1/readfile": true,
+}
+
+// The transport keeps idle connections to every host so fan-outs and repeated calls
+// reuse them. Responses are transparently decompressed when holly sends gzip. HTTP/2 is
+// only negotiated with https holly urls, plain http ones stay on HTTP/1.1.
+func newHttpClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   settings.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 proxyFunc,
+		DialContext:           dialFunc(dialer),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   settings.maxConns,
+		MaxConnsPerHost:       settings.maxConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   settings.connectTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if settings.debugHttp || settings.harFile != "" {
+		transport = &debugTransport{next: transport}
+	}
+
+	return &http.Client{Timeout: settings.timeout, Transport: transport}
+}
+
+// Global flags of the shared http client.
+func clientFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: settings.timeout,
+			Usage: "overall `timeout` of each request, 0 for none",
+		},
+		cli.DurationFlag{
+			Name:  "connect-timeout",
+			Value: settings.connectTimeout,
+			Usage: "connection `timeout` of each request",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Value: settings.retries,
+			Usage: "retry failed requests up to `n` times (read-only requests and connect failures)",
+		},
+		cli.DurationFlag{
+			Name:  "retry-backoff",
+			Value: settings.backoff,
+			Usage: "initial retry `delay`, doubled (with jitter) on every attempt",
+		},
+		cli.BoolFlag{
+			Name:  "retry-mutating",
+			Usage: "also retry failed exec, upload and update requests",
+		},
+		cli.IntFlag{
+			Name:  "max-conns-per-host",
+			Value: settings.maxConns,
+			Usage: "limit of concurrent connections to each host, 0 for none",
+		},
+		cli.BoolFlag{
+			Name:  "compress",
+			Usage: "gzip text request bodies (holly must accept Content-Encoding: gzip)",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Value:  "",
+			Usage:  "proxy `url`: http://, socks5://[user:pass@]host:port or ssh://[user@]bastion[:port] (default: HTTP_PROXY env)",
+			EnvVar: "N1_PROXY",
+		},
+		cli.BoolFlag{
+			Name:  "debug-http",
+			Usage: "dump http requests and responses (auth headers redacted)",
+		},
+		cli.IntFlag{
+			Name:  "debug-body-limit",
+			Value: settings.debugBodyLimit,
+			Usage: "dump at most `n` bytes of each body",
+		},
+		cli.StringFlag{
+			Name:  "har",
+			Value: "",
+			Usage: "record all requests of the session to har `file`",
+		},
+	}
+}
+
+// Apply the global flags to the shared http client.
+func setupClient(c *cli.Context) error {
+	settings.timeout = c.GlobalDuration("timeout")
+	settings.connectTimeout = c.GlobalDuration("connect-timeout")
+	settings.retries = c.GlobalInt("retries")
+	settings.backoff = c.GlobalDuration("retry-backoff")
+	settings.retryMutating = c.GlobalBool("retry-mutating")
+	settings.maxConns = c.GlobalInt("max-conns-per-host")
+	settings.compress = c.GlobalBool("compress")
+	settings.proxy = c.GlobalString("proxy")
+	settings.inventory = c.GlobalString("inventory")
+	settings.debugHttp = c.GlobalBool("debug-http")
+	settings.debugBodyLimit = c.GlobalInt("debug-body-limit")
+	settings.harFile = c.GlobalString("har")
+	if settings.proxy != "" {
+		if _, err := parseProxy(settings.proxy); err != nil {
+			errorln(err)
+			return err
+		}
+	}
+
+	httpClient = newHttpClient()
+	return nil
+}
+
+// Returns true if the request never reached the server, so it's always safe to retry.
+func isConnectError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// Returns the delay before retry 'attempt' (0-based): exponential with full jitter in
+// the upper half, e.g. 250-500ms, 500ms-1s, 1-2s for a 500ms base.
+func retryDelay(attempt int) time.Duration {
+	if settings.backoff <= 0 {
+		return 0
+	}
+
+	d := settings.backoff << uint(attempt)
+	if attempt >= 32 || d>>uint(attempt) != settings.backoff || d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Send the request returned by 'build', retrying according to the client settings.
+// 'build' is called again for every attempt so request bodies can be recreated.
+func doRequest(build func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		r, err := build()
+		if err != nil {
+			return nil, err
+		}
+
+		client := httpClient
+		if quickPaths[r.URL.Path] && (client.Timeout == 0 || client.Timeout > quickTimeout) {
+			c := *client
+			c.Timeout = quickTimeout
+			client = &c
+		}
+
+		retryable := idempotentPaths[r.URL.Path] || settings.retryMutating
+		resp, err := client.Do(r)
+		var reason string
+		switch {
+		case err != nil && isConnectError(err):
+			reason = err.Error()
+		case err != nil && retryable:
+			reason = err.Error()
+		case err == nil && retryable && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500):
+			reason = resp.Status
+		}
+
+		if reason == "" || attempt >= settings.retries {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		d := retryDelay(attempt)
+		warnln(fmt.Sprintf("Retry %d/%d of %s %s in %v: %s", attempt+1, settings.retries, r.Method, r.URL, d, reason))
+		time.Sleep(d)
+	}
+}
+
+// Returns true if 'b' looks like text, i.e. has no NUL bytes in its first 8KB.
+func isText(b []byte) bool {
+	if len(b) > 8192 {
+		b = b[:8192]
+	}
+
+	return bytes.IndexByte(b, 0) < 0
+}
+
+// Returns 'body' gzipped if compression is enabled and worth it, and whether it was.
+func compressBody(body []byte) ([]byte, bool) {
+	if !settings.compress || len(body) < minCompressSize || !isText(body) {
+		return body, false
+	}
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(body)
+	if err := zw.Close(); err != nil || b.Len() >= len(body) {
+		return body, false
+	}
+
+	return b.Bytes(), true
+}
+
+// Returns a request builder for 'body', recreating the reader on every call.
+func newRequest(method, url, contentType string, body []byte) func() (*http.Request, error) {
+	body, gzipped := compressBody(body)
+	return func() (*http.Request, error) {
+		var rd io.Reader
+		if body != nil {
+			rd = bytes.NewReader(body)
+		}
+
+		r, err := http.NewRequest(method, url, rd)
+		if err != nil {
+			return nil, err
+		}
+
+		if contentType != "" {
+			r.Header.Add("Content-Type", contentType)
+		}
+
+		if gzipped {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+
+		return r, nil
+	}
+}
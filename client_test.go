@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Round tripper answering with the outcomes of 'steps' in order, repeating the last one.
+// A step is either an error or a status code.
+type scriptedTransport struct {
+	steps []interface{}
+	calls int
+}
+
+func (s *scriptedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	step := s.steps[len(s.steps)-1]
+	if s.calls < len(s.steps) {
+		step = s.steps[s.calls]
+	}
+
+	s.calls++
+	if err, ok := step.(error); ok {
+		return nil, err
+	}
+
+	code := step.(int)
+	return &http.Response{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+// Restore the client settings changed by the test.
+func withSettings(t *testing.T) {
+	old := settings
+	t.Cleanup(func() { settings = old })
+}
+
+func TestDoRequestRetries(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		mutating bool
+		steps    []interface{}
+		calls    int
+		code     int
+		err      bool
+	}{
+		{"get connect error", "GET", "/api/v1/version", false, []interface{}{dialErr, 200}, 2, 200, false},
+		{"get read error", "GET", "/api/v1/version", false, []interface{}{readErr, 200}, 2, 200, false},
+		{"get 500", "GET", "/api/v1/filestat", false, []interface{}{500, 200}, 2, 200, false},
+		{"get 429", "GET", "/api/v1/readfile", false, []interface{}{429, 200}, 2, 200, false},
+		{"get 503 exhausted", "GET", "/api/v1/version", false, []interface{}{503}, 4, 503, false},
+		{"get 404", "GET", "/api/v1/version", false, []interface{}{404}, 1, 404, false},
+		{"post connect error", "POST", "/api/v1/exec", false, []interface{}{dialErr, 200}, 2, 200, false},
+		{"post read error", "POST", "/api/v1/exec", false, []interface{}{readErr, 200}, 1, 0, true},
+		{"post 503", "POST", "/api/v1/exec", false, []interface{}{503, 200}, 1, 503, false},
+		{"post 429", "POST", "/api/v1/upload", false, []interface{}{429, 200}, 1, 429, false},
+		{"post 503 retry mutating", "POST", "/api/v1/exec", true, []interface{}{503, 200}, 2, 200, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSettings(t)
+			settings.retries = 3
+			settings.backoff = 0
+			settings.retryMutating = tt.mutating
+			tr := &scriptedTransport{steps: tt.steps}
+			old := httpClient
+			httpClient = &http.Client{Transport: tr}
+			defer func() { httpClient = old }()
+
+			resp, err := doRequest(newRequest(tt.method, "http://h1:8080"+tt.path, "", []byte("cmd=dir")))
+			if tr.calls != tt.calls {
+				t.Errorf("expected %d calls, got %d", tt.calls, tr.calls)
+			}
+
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Errorf("expected %d, got %d", tt.code, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	withSettings(t)
+	settings.backoff = 0
+	for _, attempt := range []int{0, 3, 100} {
+		if d := retryDelay(attempt); d != 0 {
+			t.Errorf("attempt %d: expected no delay without backoff, got %v", attempt, d)
+		}
+	}
+
+	tests := []struct {
+		backoff  time.Duration
+		attempt  int
+		min, max time.Duration
+	}{
+		{500 * time.Millisecond, 0, 250 * time.Millisecond, 500 * time.Millisecond},
+		{500 * time.Millisecond, 1, 500 * time.Millisecond, time.Second},
+		{500 * time.Millisecond, 2, time.Second, 2 * time.Second},
+		{500 * time.Millisecond, 10, maxBackoff / 2, maxBackoff},
+		{500 * time.Millisecond, 40, maxBackoff / 2, maxBackoff},
+		{500 * time.Millisecond, 100, maxBackoff / 2, maxBackoff},
+		{time.Duration(1) << 62, 1, maxBackoff / 2, maxBackoff},
+		{time.Hour, 0, maxBackoff / 2, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		settings.backoff = tt.backoff
+		for i := 0; i < 20; i++ {
+			if d := retryDelay(tt.attempt); d < tt.min || d > tt.max {
+				t.Errorf("backoff %v, attempt %d: expected %v-%v, got %v", tt.backoff, tt.attempt, tt.min, tt.max, d)
+				break
+			}
+		}
+	}
+}
+
+func TestDoRequestQuickTimeout(t *testing.T) {
+	deadlines := map[string]bool{}
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		_, ok := r.Context().Deadline()
+		deadlines[r.URL.Path] = ok
+		return http.StatusOK, ""
+	})
+
+	for _, path := range []string{"/api/v1/version", "/api/v1/exec"} {
+		resp, err := doRequest(newRequest("GET", "http://h1:8080"+path, "", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	if !deadlines["/api/v1/version"] {
+		t.Errorf("expected a deadline on version requests")
+	}
+
+	if deadlines["/api/v1/exec"] {
+		t.Errorf("expected no deadline on exec requests without --timeout")
+	}
+}
+
+func TestNewHttpClientLimits(t *testing.T) {
+	withSettings(t)
+	settings.maxConns = 3
+	settings.connectTimeout = 5 * time.Second
+	tr, ok := newHttpClient().Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("expected an *http.Transport")
+	}
+
+	if tr.MaxConnsPerHost != 3 || tr.MaxIdleConnsPerHost != 3 {
+		t.Errorf("expected 3 connections per host, got %d (idle %d)", tr.MaxConnsPerHost, tr.MaxIdleConnsPerHost)
+	}
+
+	if tr.TLSHandshakeTimeout != 5*time.Second {
+		t.Errorf("expected a 5s handshake timeout, got %v", tr.TLSHandshakeTimeout)
+	}
+
+	settings.debugHttp = true
+	if _, ok := newHttpClient().Transport.(*debugTransport); !ok {
+		t.Errorf("expected the debug transport with --debug-http")
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	large := strings.Repeat("echo hello world\n", 100)
+	tests := []struct {
+		name     string
+		compress bool
+		body     string
+		gzipped  bool
+	}{
+		{"large text", true, large, true},
+		{"compress off", false, large, false},
+		{"small text", true, large[:minCompressSize-1], false},
+		{"binary", true, "\x00" + large, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSettings(t)
+			settings.compress = tt.compress
+			var encoding, got string
+			withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+				encoding = r.Header.Get("Content-Encoding")
+				got = body
+				return http.StatusOK, ""
+			})
+
+			resp, err := doRequest(newRequest("POST", "http://h1:8080/api/v1/exec", "text/plain", []byte(tt.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp.Body.Close()
+			if !tt.gzipped {
+				if encoding != "" || got != tt.body {
+					t.Errorf("expected the body as is, got encoding '%s' and %d bytes", encoding, len(got))
+				}
+
+				return
+			}
+
+			if encoding != "gzip" {
+				t.Fatalf("expected gzip encoding, got '%s'", encoding)
+			}
+
+			if len(got) >= len(tt.body) {
+				t.Errorf("expected a smaller body, got %d bytes", len(got))
+			}
+
+			zr, err := gzip.NewReader(bytes.NewReader([]byte(got)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadAll(zr)
+			if err != nil || string(b) != tt.body {
+				t.Errorf("expected the body back after gunzip, got %d bytes (%v)", len(b), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file layout. Top-level keys are flag names, optionally scoped to a command
+// ("timeout", "hosts", "exec.wait", "fs.ls.json"). Profiles override the top-level keys.
+//
+// The vendored urfave/cli/altsrc input sources are built against gopkg.in/urfave/cli.v1,
+// whose types don't mix with github.com/urfave/cli, so the same approach is done here:
+// values are applied in Before to every flag not set on the command line.
+type config struct {
+	Values   map[string]interface{}            `yaml:",inline"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles,omitempty"`
+}
+
+// Config loaded in the app's Before, with the selected profile.
+var loadedConfig = &config{}
+var loadedProfile string
+
+// Returns the default config file, ~/.config/n1/config.yaml on Linux.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.yaml"
+	}
+
+	return filepath.Join(dir, "n1", "config.yaml")
+}
+
+// Load the config file. A missing file yields an empty config.
+func loadConfig(file string) (*config, error) {
+	cfg := &config{}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+
+		errorln(err)
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *config) save(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, b, 0600)
+}
+
+// Returns the value of 'key' from 'profile' if set there, or from the top level.
+func (cfg *config) get(profile, key string) (interface{}, bool) {
+	if v, ok := cfg.Profiles[profile][key]; ok {
+		return v, true
+	}
+
+	v, ok := cfg.Values[key]
+	return v, ok
+}
+
+// Returns the N1_* environment variable name of a flag, e.g. N1_CONNECT_TIMEOUT.
+func envName(flag string) string {
+	return "N1_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Returns the values to set for 'flag' of the command at 'path' (e.g. "fs.ls", empty for
+// global flags): N1_* env var first, then the profile, then the top level of the config.
+// Command-scoped keys take precedence over plain flag names.
+func configValues(path, flag string) ([]string, bool) {
+	if v, ok := os.LookupEnv(envName(flag)); ok {
+		return []string{v}, true
+	}
+
+	keys := []string{flag}
+	if path != "" {
+		keys = []string{path + "." + flag, flag}
+	}
+
+	sources := []map[string]interface{}{}
+	if loadedProfile != "" {
+		sources = append(sources, loadedConfig.Profiles[loadedProfile])
+	}
+
+	for _, src := range append(sources, loadedConfig.Values) {
+		for _, key := range keys {
+			v, ok := src[key]
+			if !ok {
+				continue
+			}
+
+			if list, isList := v.([]interface{}); isList {
+				out := []string{}
+				for _, e := range list {
+					out = append(out, fmt.Sprint(e))
+				}
+
+				return out, true
+			}
+
+			return []string{fmt.Sprint(v)}, true
+		}
+	}
+
+	return nil, false
+}
+
+// Set every flag in 'flags' that isn't set on the command line (or by its own EnvVar)
+// from the environment or the config.
+func applyConfig(c *cli.Context, flags []cli.Flag, path string) error {
+	// IsSet caches its answer on first use; ask a copy of the context so the flags set
+	// here are seen as set by the command.
+	probe := *c
+	for _, f := range flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		if name == "config" || name == "profile" || probe.IsSet(name) {
+			continue
+		}
+
+		values, ok := configValues(path, name)
+		if !ok {
+			continue
+		}
+
+		for _, v := range values {
+			if err := c.Set(name, v); err != nil {
+				err = fmt.Errorf("Invalid value '%s' for '%s' in config: %v", v, name, err)
+				errorln(err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Load the config and profile from the global flags and apply them to the global flags.
+func setupConfig(c *cli.Context) error {
+	cfg, err := loadConfig(c.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+
+	// 'config set' may create the profile.
+	profile := c.GlobalString("profile")
+	if _, ok := cfg.Profiles[profile]; profile != "" && !ok && c.Args().First() != "config" {
+		return fmt.Errorf("Profile '%s' not found in %s.", profile, c.GlobalString("config"))
+	}
+
+	loadedConfig, loadedProfile = cfg, profile
+	return applyConfig(c, c.App.Flags, "")
+}
+
+// Chain config loading in the Before of every command, recursing into subcommands.
+func withConfig(cmds []cli.Command, prefix string) {
+	for i := range cmds {
+		cmd := &cmds[i]
+		path := strings.TrimPrefix(prefix+"."+cmd.Name, ".")
+		if len(cmd.Subcommands) > 0 {
+			withConfig(cmd.Subcommands, path)
+			continue
+		}
+
+		before, flags := cmd.Before, cmd.Flags
+		cmd.Before = func(c *cli.Context) error {
+			if err := applyConfig(c, flags, path); err != nil {
+				return err
+			}
+
+			if before != nil {
+				return before(c)
+			}
+
+			return nil
+		}
+	}
+}
+
+// Global flags selecting the config file and profile.
+func configFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  defaultConfigFile(),
+			Usage:  "config `file` with flag defaults",
+			EnvVar: "N1_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Value:  "",
+			Usage:  "config `profile` to apply, e.g. staging or prod",
+			EnvVar: "N1_PROFILE",
+		},
+	}
+}
+
+// Parse a value given to 'config set'. Integers and booleans keep their type; anything else
+// (e.g. "1.10", "010" or "yes") is stored as the given string so it reads back unchanged.
+func parseConfigValue(s string) interface{} {
+	if n, err := strconv.Atoi(s); err == nil && strconv.Itoa(n) == s {
+		return n
+	}
+
+	if b, err := strconv.ParseBool(s); err == nil && strconv.FormatBool(b) == s {
+		return b
+	}
+
+	return s
+}
+
+func configCommand() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "manage the config file (use the global --profile to target a profile)",
+		Subcommands: []cli.Command{
+			{
+				Name:      "get",
+				Usage:     "print the value of a key",
+				ArgsUsage: "<key>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("Expecting a single key.")
+					}
+
+					v, ok := loadedConfig.get(loadedProfile, c.Args().First())
+					if !ok {
+						return fmt.Errorf("Key '%s' not set.", c.Args().First())
+					}
+
+					fmt.Println(v)
+					return nil
+				},
+			},
+			{
+				Name:      "set",
+				Usage:     "set a key, or remove it with an empty value",
+				ArgsUsage: "<key> <value>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return fmt.Errorf("Expecting a key and a value.")
+					}
+
+					file := c.GlobalString("config")
+					cfg, err := loadConfig(file)
+					if err != nil {
+						return err
+					}
+
+					values := cfg.Values
+					if p := c.GlobalString("profile"); p != "" {
+						if cfg.Profiles == nil {
+							cfg.Profiles = map[string]map[string]interface{}{}
+						}
+
+						if cfg.Profiles[p] == nil {
+							cfg.Profiles[p] = map[string]interface{}{}
+						}
+
+						values = cfg.Profiles[p]
+					} else if values == nil {
+						cfg.Values = map[string]interface{}{}
+						values = cfg.Values
+					}
+
+					key, value := c.Args().Get(0), c.Args().Get(1)
+					if value == "" {
+						delete(values, key)
+					} else {
+						values[key] = parseConfigValue(value)
+					}
+
+					return cfg.save(file)
+				},
+			},
+			{
+				Name:  "view",
+				Usage: "print the effective config (with the selected profile applied)",
+				Action: func(c *cli.Context) error {
+					fmt.Println("# " + c.GlobalString("config"))
+					keys := []string{}
+					seen := map[string]bool{}
+					for k := range loadedConfig.Values {
+						keys, seen[k] = append(keys, k), true
+					}
+
+					for k := range loadedConfig.Profiles[loadedProfile] {
+						if !seen[k] {
+							keys = append(keys, k)
+						}
+					}
+
+					sort.Strings(keys)
+					for _, k := range keys {
+						v, _ := loadedConfig.get(loadedProfile, k)
+						b, _ := yaml.Marshal(map[string]interface{}{k: v})
+						fmt.Print(string(b))
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want interface{}
+	}{
+		{"8", 8},
+		{"-1", -1},
+		{"true", true},
+		{"false", false},
+		{"1.10", "1.10"},
+		{"010", "010"},
+		{"+5", "+5"},
+		{"yes", "yes"},
+		{"1", 1},
+		{"10s", "10s"},
+		{"[a, b]", "[a, b]"},
+		{"a: b", "a: b"},
+		{"~", "~"},
+	} {
+		if got := parseConfigValue(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseConfigValue(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConfigValueRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := &config{Values: map[string]interface{}{}}
+	for _, v := range []string{"1.10", "yes", "010", "~", "8", "true"} {
+		cfg.Values["k"+v] = parseConfigValue(v)
+	}
+
+	if err := cfg.save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, profile := loadedConfig, loadedProfile
+	defer func() { loadedConfig, loadedProfile = saved, profile }()
+
+	var err error
+	loadedConfig, err = loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedProfile = ""
+	for _, v := range []string{"1.10", "yes", "010", "~", "8", "true"} {
+		got, ok := configValues("", "k"+v)
+		if !ok || len(got) != 1 || got[0] != v {
+			t.Errorf("configValues(%q) = %q, %v, want %q", "k"+v, got, ok, v)
+		}
+	}
+}
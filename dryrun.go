@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Status returned in place of the response status for requests skipped by --dry-run.
+const dryRunStatus = "200 OK (dry run)"
+
+// Print a dry-run line on stdout.
+func dryRunf(format string, v ...interface{}) {
+	logOut.Lock()
+	defer logOut.Unlock()
+	fmt.Printf("[dry-run] "+format+"\n", v...)
+}
+
+// Print the hosts a command resolved to.
+func dryRunHosts(hosts []string) {
+	if settings.dryRun {
+		dryRunf("hosts (%d): %s", len(hosts), strings.Join(hosts, ","))
+	}
+}
+
+// Print the request that would be sent, with its query parameters and payload. Returns
+// true if --dry-run is set, in which case the caller must not send it.
+func dryRunRequest(method, rawurl string, files []auditFile, cmd string) bool {
+	if !settings.dryRun {
+		return false
+	}
+
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		host = u.Hostname()
+		dryRunf("[%s] %s %s", host, method, u.Path)
+		q := u.Query()
+		keys := []string{}
+		for k := range q {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		for _, k := range keys {
+			dryRunf("[%s]   %s=%s", host, k, strings.Join(q[k], ","))
+		}
+	}
+
+	for _, f := range files {
+		dest := ""
+		if f.Dest != "" {
+			dest = " -> " + f.Dest
+		}
+
+		dryRunf("[%s]   file: %s%s (%d bytes, sha256 %s)", host, f.Path, dest, f.Size, f.Sha256)
+	}
+
+	if cmd != "" {
+		dryRunf("[%s]   cmd: %s", host, cmd)
+	}
+
+	return true
+}
+
+// Print a change that would be made in 'host'. Returns true if --dry-run is set.
+func dryRunOp(host, op, detail string) bool {
+	if settings.dryRun {
+		dryRunf("[%s] %s %s", host, op, detail)
+	}
+
+	return settings.dryRun
+}
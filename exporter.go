@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Result of probing a single host for the exporter.
+type probeResult struct {
+	host     string
+	up       bool
+	duration time.Duration
+	holly    string
+	runner   string
+	stats    []fileStat
+	facts    hostFacts
+}
+
+type exporter struct {
+	hosts   []string
+	files   []string
+	runner  string
+	disk    bool
+	timeout time.Duration
+
+	mu      sync.Mutex
+	results []probeResult
+	last    time.Time
+	elapsed time.Duration
+}
+
+func (e *exporter) probe(host string) probeResult {
+	r := probeResult{host: host}
+	start := time.Now()
+	body, status, err := httpGetVersion(host)
+	r.duration = time.Since(start)
+	if err != nil || !strings.HasPrefix(status, "200") {
+		return r
+	}
+
+	r.up = true
+	r.holly = strings.TrimSpace(string(body))
+	if e.runner != "" {
+		r.runner, _ = remoteRunnerVersion(host, e.runner)
+	}
+
+	if len(e.files) > 0 {
+		r.stats, _ = httpFileStats(host, e.files)
+	}
+
+	if e.disk {
+		r.facts, _ = gatherFacts(host)
+	}
+
+	return r
+}
+
+// Probe all hosts concurrently and replace the served results. Hosts not answering
+// within the probe timeout are reported down, so one hung host never stalls the rest.
+func (e *exporter) probeAll() {
+	start := time.Now()
+	res := make([]probeResult, len(e.hosts))
+	var wg sync.WaitGroup
+	for i, host := range e.hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			done := make(chan probeResult, 1)
+			go func() { done <- e.probe(host) }()
+			select {
+			case res[i] = <-done:
+			case <-time.After(e.timeout):
+				withHost(host).warnln("Probe timed out after", e.timeout)
+				res[i] = probeResult{host: host, duration: e.timeout}
+			}
+		}(i, host)
+	}
+
+	wg.Wait()
+	e.mu.Lock()
+	e.results = res
+	e.last = time.Now()
+	e.elapsed = time.Since(start)
+	e.mu.Unlock()
+}
+
+// Escape a Prometheus label value.
+func promLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func promBool(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// Write the metrics in the Prometheus text exposition format.
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	results := e.results
+	last, elapsed := e.last, e.elapsed
+	e.mu.Unlock()
+
+	var b bytes.Buffer
+	metric := func(name, help, typ string, fn func()) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		fn()
+	}
+
+	metric("n1_holly_up", "Whether the holly version endpoint answered.", "gauge", func() {
+		for _, p := range results {
+			fmt.Fprintf(&b, "n1_holly_up{host=\"%s\"} %d\n", promLabel(p.host), promBool(p.up))
+		}
+	})
+
+	metric("n1_holly_response_seconds", "Response time of the holly version endpoint.", "gauge", func() {
+		for _, p := range results {
+			fmt.Fprintf(&b, "n1_holly_response_seconds{host=\"%s\"} %g\n", promLabel(p.host), p.duration.Seconds())
+		}
+	})
+
+	metric("n1_holly_version_info", "Holly version running in the host.", "gauge", func() {
+		for _, p := range results {
+			if p.up {
+				fmt.Fprintf(&b, "n1_holly_version_info{host=\"%s\",version=\"%s\"} 1\n", promLabel(p.host), promLabel(p.holly))
+			}
+		}
+	})
+
+	if e.runner != "" {
+		metric("n1_runner_version_info", "Gitlab runner version installed in the host.", "gauge", func() {
+			for _, p := range results {
+				if p.runner != "" {
+					fmt.Fprintf(&b, "n1_runner_version_info{host=\"%s\",version=\"%s\"} 1\n", promLabel(p.host), promLabel(p.runner))
+				}
+			}
+		})
+	}
+
+	if len(e.files) > 0 {
+		metric("n1_file_exists", "Whether the file exists in the host.", "gauge", func() {
+			for _, p := range results {
+				for _, st := range p.stats {
+					fmt.Fprintf(&b, "n1_file_exists{host=\"%s\",path=\"%s\"} %d\n", promLabel(p.host), promLabel(st.Path), promBool(st.Exists))
+				}
+			}
+		})
+
+		metric("n1_file_size_bytes", "Size of the file in the host.", "gauge", func() {
+			for _, p := range results {
+				for _, st := range p.stats {
+					if st.Exists {
+						fmt.Fprintf(&b, "n1_file_size_bytes{host=\"%s\",path=\"%s\"} %d\n", promLabel(p.host), promLabel(st.Path), st.Size)
+					}
+				}
+			}
+		})
+	}
+
+	if e.disk {
+		for _, m := range []struct{ name, fact, help string }{
+			{"n1_disk_free_bytes", "disk_free", "Free space of the system disk."},
+			{"n1_disk_total_bytes", "disk_total", "Size of the system disk."},
+		} {
+			metric(m.name, m.help, "gauge", func() {
+				for _, p := range results {
+					if v, err := strconv.ParseFloat(p.facts[m.fact], 64); err == nil {
+						fmt.Fprintf(&b, "%s{host=\"%s\"} %g\n", m.name, promLabel(p.host), v)
+					}
+				}
+			})
+		}
+	}
+
+	metric("n1_probe_duration_seconds", "Time taken by the last probe of all hosts.", "gauge", func() {
+		fmt.Fprintf(&b, "n1_probe_duration_seconds %g\n", elapsed.Seconds())
+	})
+
+	metric("n1_probe_timestamp_seconds", "Time of the last probe of all hosts.", "gauge", func() {
+		fmt.Fprintf(&b, "n1_probe_timestamp_seconds %d\n", last.Unix())
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func exporterCommand() cli.Command {
+	return cli.Command{
+		Name:  "exporter",
+		Usage: "serve fleet health as prometheus metrics",
+		Flags: append(hostsFlags(),
+			cli.StringFlag{
+				Name:  "listen",
+				Value: ":9110",
+				Usage: "`address` to serve /metrics on",
+			},
+			cli.StringFlag{
+				Name:  "inventory",
+				Value: "",
+				Usage: "inventory `file` (default: global --inventory)",
+			},
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: time.Minute,
+				Usage: "probe `interval`",
+			},
+			cli.StringFlag{
+				Name:  "files",
+				Value: "",
+				Usage: "comma-separated file list to report existence and size of",
+			},
+			cli.StringFlag{
+				Name:  "runner",
+				Value: runnerPath,
+				Usage: "runner binary `path` in the hosts, empty to skip the runner version",
+			},
+			cli.BoolFlag{
+				Name:  "disk",
+				Usage: "report system disk space (gathers facts on every probe)",
+			},
+			cli.DurationFlag{
+				Name:  "probe-timeout",
+				Value: 30 * time.Second,
+				Usage: "report hosts down when a probe takes longer than `duration`",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			// Export the whole inventory unless told otherwise.
+			if !c.IsSet("hosts") && !c.IsSet("group") {
+				c.Set("group", "all")
+			}
+
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			e := &exporter{
+				hosts:  hosts,
+				files:  splitList(c.String("files")),
+				runner: c.String("runner"),
+				disk:   c.Bool("disk"),
+
+				timeout: c.Duration("probe-timeout"),
+			}
+
+			e.probeAll()
+			go func() {
+				for {
+					time.Sleep(c.Duration("interval"))
+					e.probeAll()
+				}
+			}()
+
+			http.Handle("/metrics", e)
+			infoln("Serving metrics for", len(hosts), "host(s) on", c.String("listen")+"/metrics")
+			return http.ListenAndServe(c.String("listen"), nil)
+		},
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Cached facts older than this are gathered again.
+const defaultFactsTTL = time.Hour
+
+// Facts of a single host, e.g. "os", "arch", "hostname". All values are strings so they
+// can be used as-is in templates and --where filters.
+type hostFacts map[string]string
+
+// Cached facts of a host.
+type factsEntry struct {
+	Time  time.Time `json:"time"`
+	Facts hostFacts `json:"facts"`
+}
+
+var factsScriptWindows = `$os = Get-CimInstance Win32_OperatingSystem
+$d = Get-CimInstance Win32_LogicalDisk -Filter "DeviceID='C:'"
+'os=windows'
+'os_name=' + $os.Caption
+'os_version=' + $os.Version
+'arch=' + $env:PROCESSOR_ARCHITECTURE
+'hostname=' + $env:COMPUTERNAME
+'disk_free=' + $d.FreeSpace
+'disk_total=' + $d.Size
+'uptime=' + [int64]((Get-Date) - $os.LastBootUpTime).TotalSeconds`
+
+var factsScriptSh = `echo os=$(uname -s | tr A-Z a-z)
+echo os_name=$(uname -sr)
+echo os_version=$(uname -r)
+echo arch=$(uname -m)
+echo hostname=$(hostname)
+df -Pk / | awk 'NR==2 { printf "disk_free=%.0f\ndisk_total=%.0f\n", $4*1024, $2*1024 }'
+echo uptime=$(cut -d. -f1 /proc/uptime)`
+
+// Normalize architecture names to Go's naming.
+func normalizeArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "x86_64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "x86", "i386", "i686":
+		return "386"
+	}
+
+	return strings.ToLower(arch)
+}
+
+// Parse 'key=value' lines into 'facts'.
+func parseFacts(out string, facts hostFacts) {
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			facts[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+}
+
+// Gather the standard facts of 'host' through the exec and version endpoints.
+func gatherFacts(host string) (hostFacts, error) {
+	facts := hostFacts{"host": host}
+	body, status, err := httpGetVersion(host)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	if strings.HasPrefix(status, "200") {
+		facts["holly_version"] = strings.TrimSpace(string(body))
+	}
+
+	// Windows answers 'ver', everything else is treated as a posix shell.
+	body, status, err = httpExec(host, `cmd /c ver`, false, true, 0)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	windows := strings.HasPrefix(status, "200") && strings.Contains(string(body), "Windows")
+	out, err := fsExec(host, windows, factsScriptWindows, factsScriptSh)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	parseFacts(out, facts)
+	facts["arch"] = normalizeArch(facts["arch"])
+	runner := "gitlab-runner"
+	if windows {
+		runner = runnerPath
+	}
+
+	if rv, err := remoteRunnerVersion(host, runner); err == nil && rv != "" {
+		facts["runner_version"] = rv
+	}
+
+	return facts, nil
+}
+
+// Returns the facts cache file.
+func factsCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "n1", "facts.json")
+}
+
+func loadFactsCache() map[string]factsEntry {
+	cache := map[string]factsEntry{}
+	b, err := ioutil.ReadFile(factsCacheFile())
+	if err == nil {
+		json.Unmarshal(b, &cache)
+	}
+
+	return cache
+}
+
+func saveFactsCache(cache map[string]factsEntry) error {
+	file := factsCacheFile()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	b, _ := json.MarshalIndent(cache, "", "  ")
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// Returns the facts of all hosts, from the cache when younger than 'ttl' and gathered
+// concurrently otherwise. Hosts that fail are left out of the result.
+func hostsFacts(hosts []string, ttl time.Duration) map[string]hostFacts {
+	cache := loadFactsCache()
+	res := map[string]hostFacts{}
+	stale := []string{}
+	for _, host := range hosts {
+		if e, ok := cache[host]; ok && time.Since(e.Time) < ttl {
+			res[host] = e.Facts
+		} else {
+			stale = append(stale, host)
+		}
+	}
+
+	// Only the goroutines below touch 'res' and 'cache' from here on, under 'mu'.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, host := range stale {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			facts, err := gatherFacts(host)
+			if err != nil {
+				withHost(host).warnln("Gathering facts failed:", err)
+				return
+			}
+
+			mu.Lock()
+			res[host] = facts
+			cache[host] = factsEntry{Time: time.Now(), Facts: facts}
+			mu.Unlock()
+		}(host)
+	}
+
+	wg.Wait()
+	if err := saveFactsCache(cache); err != nil {
+		errorln(err)
+	}
+
+	return res
+}
+
+// A single --where condition, e.g. "os=windows" or "arch!=386".
+type factFilter struct {
+	key   string
+	neg   bool
+	value string
+}
+
+func parseWhere(where string) ([]factFilter, error) {
+	filters := []factFilter{}
+	for _, cond := range splitList(where) {
+		f := factFilter{}
+		kv := strings.SplitN(cond, "!=", 2)
+		if len(kv) == 2 {
+			f.neg = true
+		} else {
+			kv = strings.SplitN(cond, "=", 2)
+		}
+
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid condition '%s'.", cond)
+		}
+
+		f.key, f.value = strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+// Returns true if the facts satisfy all filters. Values are compared case-insensitively.
+func matchFacts(facts hostFacts, filters []factFilter) bool {
+	for _, f := range filters {
+		if strings.EqualFold(facts[f.key], f.value) == f.neg {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns true if the host's inventory 'tags' satisfy all "tag" filters.
+func matchTags(tags []string, filters []factFilter) bool {
+	for _, f := range filters {
+		found := false
+		for _, t := range tags {
+			found = found || strings.EqualFold(t, f.value)
+		}
+
+		if found == f.neg {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the hosts whose facts match 'where'. "tag" conditions match the host's inventory
+// 'tags' instead, and facts are only gathered if other conditions need them.
+func filterHostsByFacts(hosts []string, where string, ttl time.Duration, tags map[string][]string) ([]string, error) {
+	filters, err := parseWhere(where)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	factFilters, tagFilters := []factFilter{}, []factFilter{}
+	for _, f := range filters {
+		if f.key == "tag" {
+			tagFilters = append(tagFilters, f)
+		} else {
+			factFilters = append(factFilters, f)
+		}
+	}
+
+	facts := map[string]hostFacts{}
+	if len(factFilters) > 0 {
+		facts = hostsFacts(hosts, ttl)
+	}
+
+	out := []string{}
+	for _, host := range hosts {
+		if !matchTags(tags[host], tagFilters) {
+			continue
+		}
+
+		if f, ok := facts[host]; len(factFilters) == 0 || (ok && matchFacts(f, factFilters)) {
+			out = append(out, host)
+		}
+	}
+
+	return out, nil
+}
+
+func factsCommand() cli.Command {
+	return cli.Command{
+		Name:  "facts",
+		Usage: "gather host facts (os, arch, hostname, disk, uptime, versions)",
+		Flags: append(hostsFlags(),
+			cli.DurationFlag{
+				Name:  "ttl",
+				Value: defaultFactsTTL,
+				Usage: "use cached facts younger than `duration`",
+			},
+			cli.BoolFlag{
+				Name:  "refresh",
+				Usage: "ignore cached facts",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			ttl := c.Duration("ttl")
+			if c.Bool("refresh") {
+				ttl = 0
+			}
+
+			facts := hostsFacts(hosts, ttl)
+			b, _ := json.MarshalIndent(facts, "", "  ")
+			fmt.Println(string(b))
+			missing := []string{}
+			for _, host := range hosts {
+				if _, ok := facts[host]; !ok {
+					missing = append(missing, host)
+				}
+			}
+
+			if len(missing) > 0 {
+				sort.Strings(missing)
+				return fmt.Errorf("No facts from: %s", strings.Join(missing, ","))
+			}
+
+			return nil
+		},
+	}
+}
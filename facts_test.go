@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostsFactsMixedCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/version"):
+			return 200, "1.2.3"
+		case strings.Contains(body, "uname"):
+			return 200, "os=linux\narch=x86_64\nhostname=" + r.URL.Hostname() + "\n"
+		}
+
+		return 500, "not found"
+	})
+
+	// Cached and uncached hosts alternate, so the cache is read while facts are gathered.
+	// Repeated because the race detector doesn't catch every interleaving.
+	for round := 0; round < 10; round++ {
+		cache := map[string]factsEntry{}
+		hosts := []string{}
+		for i := 0; i < 20; i++ {
+			host := fmt.Sprintf("h%d", i)
+			hosts = append(hosts, host)
+			if i%2 == 0 {
+				cache[host] = factsEntry{Time: time.Now(), Facts: hostFacts{"host": host, "os": "cached"}}
+			}
+		}
+
+		if err := saveFactsCache(cache); err != nil {
+			t.Fatal(err)
+		}
+
+		res := hostsFacts(hosts, time.Hour)
+		if len(res) != len(hosts) {
+			t.Fatalf("got facts for %d hosts, want %d", len(res), len(hosts))
+		}
+
+		for i, host := range hosts {
+			want := "linux"
+			if i%2 == 0 {
+				want = "cached"
+			}
+
+			if res[host]["os"] != want {
+				t.Errorf("%s: os = %q, want %q", host, res[host]["os"], want)
+			}
+		}
+
+		if got := loadFactsCache(); len(got) != len(hosts) {
+			t.Errorf("cache has %d hosts, want %d", len(got), len(hosts))
+		}
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	filters, err := parseWhere("os=windows, arch!=386")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	facts := hostFacts{"os": "Windows", "arch": "amd64"}
+	if !matchFacts(facts, filters) {
+		t.Errorf("expected %v to match", facts)
+	}
+
+	facts["arch"] = "386"
+	if matchFacts(facts, filters) {
+		t.Errorf("expected %v not to match", facts)
+	}
+
+	if _, err := parseWhere("os"); err == nil {
+		t.Error("expected an error for a condition without '='")
+	}
+
+	tags := []factFilter{{key: "tag", value: "gpu"}, {key: "tag", neg: true, value: "old"}}
+	if !matchTags([]string{"GPU", "docker"}, tags) || matchTags([]string{"gpu", "old"}, tags) || matchTags(nil, tags) {
+		t.Error("unexpected tag match")
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf16"
+
+	"github.com/urfave/cli"
+)
+
+// A remote directory entry.
+type fsEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// Request body of holly's native filesystem endpoints (/api/v1/fs/<op>).
+type fsRequest struct {
+	Path      string `json:"path"`
+	Dest      string `json:"dest,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+// Per-host result of a filesystem operation.
+type fsResult struct {
+	Host    string    `json:"host"`
+	Entries []fsEntry `json:"entries,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var errNoNative = fmt.Errorf("No native endpoint.")
+
+// Hosts known to lack the native filesystem endpoints.
+var fsNoNative = struct {
+	sync.Mutex
+	hosts map[string]bool
+}{hosts: map[string]bool{}}
+
+// Call holly's native filesystem endpoint for 'op'. Returns errNoNative if holly doesn't
+// provide it, in which case callers fall back to exec.
+func fsNative(host, op string, req fsRequest, out interface{}) error {
+	fsNoNative.Lock()
+	skip := fsNoNative.hosts[host]
+	fsNoNative.Unlock()
+	if skip {
+		return errNoNative
+	}
+
+	b, _ := json.Marshal(req)
+	url := `http://` + host + `:8080/api/v1/fs/` + op
+	resp, err := doRequest(newRequest("POST", url, "application/json", b))
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out != nil {
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		fsNoNative.Lock()
+		fsNoNative.hosts[host] = true
+		fsNoNative.Unlock()
+		return errNoNative
+	}
+
+	return fmt.Errorf("%s failed with status: %s", op, resp.Status)
+}
+
+// Quote a string as a PowerShell literal. Nothing inside single quotes is expanded.
+func psQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `''`, -1) + `'`
+}
+
+// Returns a powershell command line running 'script'. The script is passed encoded so no
+// shell in between can reinterpret it.
+func psCommand(script string) string {
+	u := utf16.Encode([]rune(`$ErrorActionPreference = 'Stop'; ` + script))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		b[i*2] = byte(c)
+		b[i*2+1] = byte(c >> 8)
+	}
+
+	return `powershell -NoProfile -NonInteractive -EncodedCommand ` + base64.StdEncoding.EncodeToString(b)
+}
+
+// Run a fallback filesystem command. 'windows' selects 'ps' (powershell) over 'sh'.
+// Returns the command output.
+func fsExec(host string, windows bool, ps, sh string) (string, error) {
+	cmd := sh
+	if windows {
+		cmd = psCommand(ps)
+	}
+
+	body, status, err := httpExec(host, cmd, false, true, 0)
+	if err != nil {
+		errorln(err)
+		return "", err
+	}
+
+	if !strings.HasPrefix(status, "200") {
+		return string(body), fmt.Errorf("%s: %s", status, strings.TrimSpace(string(body)))
+	}
+
+	return string(body), nil
+}
+
+// List the entries of the remote directory 'path'.
+func fsList(host, path string) ([]fsEntry, error) {
+	var entries []fsEntry
+	err := fsNative(host, "ls", fsRequest{Path: path}, &entries)
+	if err != errNoNative {
+		return entries, err
+	}
+
+	windows := remoteShell(path) == "cmd"
+	ps := `Get-ChildItem -Force -LiteralPath ` + psQuote(path) + ` | ForEach-Object { '{0}` + "`t" + `{1}` + "`t" +
+		`{2}` + "`t" + `{3}' -f $_.Name, $_.PSIsContainer, $_.Length, $_.LastWriteTimeUtc.ToString('o') }`
+	sh := `find ` + quoteArg("sh", path) + ` -mindepth 1 -maxdepth 1 -printf '%f\t%y\t%s\t%T@\n'`
+	out, err := fsExec(host, windows, ps, sh)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = []fsEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(f) != 4 {
+			continue
+		}
+
+		e := fsEntry{Name: f[0], Dir: f[1] == "True" || f[1] == "d"}
+		e.Size, _ = strconv.ParseInt(f[2], 10, 64)
+		if windows {
+			e.ModTime, _ = time.Parse(time.RFC3339Nano, f[3])
+		} else if sec, err := strconv.ParseFloat(f[3], 64); err == nil {
+			e.ModTime = time.Unix(int64(sec), 0).UTC()
+		}
+
+		if e.Dir {
+			e.Size = 0
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Create the remote directory 'path', including parents.
+func fsMkdir(host, path string) (err error) {
+	if dryRunOp(host, "mkdir", path) {
+		return nil
+	}
+
+	defer func() { auditOp("fs-mkdir", host, path, err) }()
+	err = fsNative(host, "mkdir", fsRequest{Path: path}, nil)
+	if err != errNoNative {
+		return err
+	}
+
+	_, err = fsExec(host, remoteShell(path) == "cmd",
+		`New-Item -ItemType Directory -Force -Path `+psQuote(path)+` | Out-Null`,
+		`mkdir -p `+quoteArg("sh", path))
+	return err
+}
+
+// Move or rename 'src' to 'dst'.
+func fsMove(host, src, dst string) (err error) {
+	if dryRunOp(host, "mv", src+" -> "+dst) {
+		return nil
+	}
+
+	defer func() { auditOp("fs-mv", host, src+" -> "+dst, err) }()
+	err = fsNative(host, "mv", fsRequest{Path: src, Dest: dst}, nil)
+	if err != errNoNative {
+		return err
+	}
+
+	_, err = fsExec(host, remoteShell(src) == "cmd",
+		`Move-Item -Force -LiteralPath `+psQuote(src)+` -Destination `+psQuote(dst),
+		`mv -f `+quoteArg("sh", src)+` `+quoteArg("sh", dst))
+	return err
+}
+
+// Remove 'path'. Directories require 'recursive'.
+func fsRemove(host, path string, recursive bool) (err error) {
+	if dryRunOp(host, "rm", path) {
+		return nil
+	}
+
+	defer func() { auditOp("fs-rm", host, path, err) }()
+	err = fsNative(host, "rm", fsRequest{Path: path, Recursive: recursive}, nil)
+	if err != errNoNative {
+		return err
+	}
+
+	ps := `Remove-Item -Force -LiteralPath ` + psQuote(path)
+	sh := `rm -f ` + quoteArg("sh", path)
+	if recursive {
+		ps = ps + ` -Recurse`
+		sh = `rm -rf ` + quoteArg("sh", path)
+	}
+
+	_, err = fsExec(host, remoteShell(path) == "cmd", ps, sh)
+	return err
+}
+
+// Copy 'src' to 'dst'. Directories require 'recursive'.
+func fsCopy(host, src, dst string, recursive bool) (err error) {
+	if dryRunOp(host, "cp", src+" -> "+dst) {
+		return nil
+	}
+
+	defer func() { auditOp("fs-cp", host, src+" -> "+dst, err) }()
+	err = fsNative(host, "cp", fsRequest{Path: src, Dest: dst, Recursive: recursive}, nil)
+	if err != errNoNative {
+		return err
+	}
+
+	ps := `Copy-Item -Force -LiteralPath ` + psQuote(src) + ` -Destination ` + psQuote(dst)
+	sh := `cp -f ` + quoteArg("sh", src) + ` ` + quoteArg("sh", dst)
+	if recursive {
+		ps = ps + ` -Recurse`
+		sh = `cp -rf ` + quoteArg("sh", src) + ` ` + quoteArg("sh", dst)
+	}
+
+	_, err = fsExec(host, remoteShell(src) == "cmd", ps, sh)
+	return err
+}
+
+// Run 'fn' against all hosts concurrently. Results are in the order of 'hosts'.
+func fsFanOut(hosts []string, fn func(host string) ([]fsEntry, error)) []fsResult {
+	res := make([]fsResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			res[i].Host = host
+			entries, err := fn(host)
+			if err != nil {
+				res[i].Error = err.Error()
+				return
+			}
+
+			res[i].Entries = entries
+		}(i, host)
+	}
+
+	wg.Wait()
+	return res
+}
+
+func printFsResults(op string, results []fsResult, asJson bool) error {
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+
+	if asJson {
+		b, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		if op == "ls" {
+			fmt.Fprintln(w, "HOST\tTYPE\tSIZE\tMTIME\tNAME")
+		} else {
+			fmt.Fprintln(w, "HOST\tSTATUS")
+		}
+
+		for _, r := range results {
+			switch {
+			case r.Error != "":
+				fmt.Fprintf(w, "%s\t%s\n", r.Host, r.Error)
+			case op == "ls":
+				for _, e := range r.Entries {
+					t := "file"
+					if e.Dir {
+						t = "dir"
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Host, t, e.Size, e.ModTime.Local().Format("2006-01-02 15:04:05"), e.Name)
+				}
+			default:
+				fmt.Fprintf(w, "%s\tok\n", r.Host)
+			}
+		}
+
+		w.Flush()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%s failed on %d of %d host(s).", op, failed, len(results))
+	}
+
+	return nil
+}
+
+func fsCommand() cli.Command {
+	jsonFlag := cli.BoolFlag{
+		Name:  "json",
+		Usage: "print results as json",
+	}
+
+	recursiveFlag := cli.BoolFlag{
+		Name:  "recursive, r",
+		Usage: "operate on directories recursively",
+	}
+
+	// Build a subcommand requiring 'nargs' path arguments.
+	sub := func(name, usage, argsUsage string, nargs int, flags []cli.Flag, fn func(c *cli.Context, host string) ([]fsEntry, error)) cli.Command {
+		return cli.Command{
+			Name:      name,
+			Usage:     usage,
+			ArgsUsage: argsUsage,
+			Flags:     append(append(hostsFlags(), jsonFlag), flags...),
+			Action: func(c *cli.Context) error {
+				if c.NArg() != nargs {
+					err := fmt.Errorf("Expected %d argument(s): %s", nargs, argsUsage)
+					errorln(err)
+					return err
+				}
+
+				hosts, err := resolveHosts(c)
+				if err != nil {
+					errorln(err)
+					return err
+				}
+
+				if name != "ls" {
+					if err := confirmTargets("fs "+name, hosts); err != nil {
+						errorln(err)
+						return err
+					}
+				}
+
+				results := fsFanOut(hosts, func(host string) ([]fsEntry, error) { return fn(c, host) })
+				return printFsResults(name, results, c.Bool("json"))
+			},
+		}
+	}
+
+	return cli.Command{
+		Name:  "fs",
+		Usage: "remote filesystem operations",
+		Subcommands: []cli.Command{
+			sub("ls", "list a remote directory", "<path>", 1, nil, func(c *cli.Context, host string) ([]fsEntry, error) {
+				return fsList(host, c.Args().Get(0))
+			}),
+			sub("mkdir", "create a remote directory", "<path>", 1, nil, func(c *cli.Context, host string) ([]fsEntry, error) {
+				return nil, fsMkdir(host, c.Args().Get(0))
+			}),
+			sub("mv", "move or rename a remote file or directory", "<src> <dest>", 2, nil, func(c *cli.Context, host string) ([]fsEntry, error) {
+				return nil, fsMove(host, c.Args().Get(0), c.Args().Get(1))
+			}),
+			sub("rm", "remove a remote file or directory", "<path>", 1, []cli.Flag{recursiveFlag}, func(c *cli.Context, host string) ([]fsEntry, error) {
+				return nil, fsRemove(host, c.Args().Get(0), c.Bool("recursive"))
+			}),
+			sub("cp", "copy a remote file or directory", "<src> <dest>", 2, []cli.Flag{recursiveFlag}, func(c *cli.Context, host string) ([]fsEntry, error) {
+				return nil, fsCopy(host, c.Args().Get(0), c.Args().Get(1), c.Bool("recursive"))
+			}),
+		},
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// GitLab API settings, set from the global flags (or the config file).
+var gitlab = struct {
+	url    string
+	token  string
+	hostBy string
+}{hostBy: "ip"}
+
+// A runner as returned by the GitLab runners API.
+type gitlabRunner struct {
+	Id          int      `json:"id"`
+	Description string   `json:"description"`
+	IpAddress   string   `json:"ip_address"`
+	Active      *bool    `json:"active"`
+	Paused      bool     `json:"paused"`
+	Online      bool     `json:"online"`
+	Status      string   `json:"status"`
+	RunnerType  string   `json:"runner_type"`
+	TagList     []string `json:"tag_list"`
+}
+
+// Global flags of the GitLab API.
+func gitlabFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "gitlab-url",
+			Value:  "https://gitlab.com",
+			Usage:  "gitlab base `url` (a local fake server works too)",
+			EnvVar: "N1_GITLAB_URL",
+		},
+		cli.StringFlag{
+			Name:   "gitlab-token",
+			Value:  "",
+			Usage:  "gitlab api `token` (admin to see all runners), best kept in the config file",
+			EnvVar: "N1_GITLAB_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "gitlab-host-by",
+			Value: gitlab.hostBy,
+			Usage: "map gitlab runners to hosts by `ip` address or description",
+		},
+	}
+}
+
+func setupGitlab(c *cli.Context) {
+	gitlab.url = strings.TrimRight(c.GlobalString("gitlab-url"), "/")
+	gitlab.token = c.GlobalString("gitlab-token")
+	gitlab.hostBy = c.GlobalString("gitlab-host-by")
+}
+
+// Call the GitLab API at 'path' (relative to /api/v4) and decode the json response into
+// 'out' if not nil. 'form' is sent url-encoded. Returns the response headers' next page.
+func gitlabRequest(method, path string, form url.Values, out interface{}) (string, error) {
+	if gitlab.token == "" {
+		return "", fmt.Errorf("No gitlab token. See --gitlab-token flag for more info.")
+	}
+
+	var body []byte
+	contentType := ""
+	if form != nil {
+		body, contentType = []byte(form.Encode()), "application/x-www-form-urlencoded"
+	}
+
+	build := newRequest(method, gitlab.url+"/api/v4"+path, contentType, body)
+	resp, err := doRequest(func() (*http.Request, error) {
+		r, err := build()
+		if err == nil {
+			r.Header.Set("Private-Token", gitlab.token)
+		}
+
+		return r, err
+	})
+
+	if err != nil {
+		errorln(err)
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Gitlab %s %s failed with status: %s %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return "", fmt.Errorf("Invalid gitlab response for %s: %v", path, err)
+		}
+	}
+
+	return resp.Header.Get("X-Next-Page"), nil
+}
+
+// Returns all runners visible to the token: every runner for admins, otherwise the
+// runners of the token's projects and groups. Tags are usually missing from the list
+// (see gitlabRunnerTags).
+func gitlabRunners() ([]gitlabRunner, error) {
+	list := func(path string) ([]gitlabRunner, error) {
+		runners := []gitlabRunner{}
+		for page := "1"; page != ""; {
+			batch := []gitlabRunner{}
+			next, err := gitlabRequest("GET", path+"?per_page=100&page="+page, nil, &batch)
+			if err != nil {
+				return nil, err
+			}
+
+			runners, page = append(runners, batch...), next
+		}
+
+		return runners, nil
+	}
+
+	runners, err := list("/runners/all")
+	if err != nil && strings.Contains(err.Error(), "403") {
+		runners, err = list("/runners")
+	}
+
+	return runners, err
+}
+
+// Fill in the tags of 'runners' whose list entry had none, from the runner details.
+// Details are fetched concurrently, --max-conns-per-host at a time (all at once for 0).
+func gitlabRunnerTags(runners []gitlabRunner) error {
+	n := settings.maxConns
+	if n <= 0 {
+		n = len(runners)
+	}
+
+	sem := make(chan struct{}, n)
+	errs := make([]error, len(runners))
+	var wg sync.WaitGroup
+	for i := range runners {
+		if runners[i].TagList != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *gitlabRunner, err *error) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			_, *err = gitlabRequest("GET", "/runners/"+strconv.Itoa(r.Id), nil, r)
+		}(&runners[i], &errs[i])
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the runner of 'host', matched by ip address first, then by description.
+func gitlabRunnerOf(host string, runners []gitlabRunner) (*gitlabRunner, error) {
+	for i := range runners {
+		if runners[i].IpAddress == host {
+			return &runners[i], nil
+		}
+	}
+
+	for i := range runners {
+		if strings.EqualFold(runners[i].Description, host) {
+			return &runners[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("No gitlab runner found for %s.", host)
+}
+
+// Returns the holly host of runner 'r': its ip address or description, per --gitlab-host-by,
+// falling back to the other one when empty.
+func runnerHost(r gitlabRunner) string {
+	first, second := r.IpAddress, r.Description
+	if gitlab.hostBy == "description" {
+		first, second = second, first
+	}
+
+	if first != "" {
+		return first
+	}
+
+	return second
+}
+
+// Returns true if runner 'r' satisfies all filters (see parseWhere). Keys are the runner's
+// id, description, ip, status, online, paused, type and tag, the latter matching any of
+// its tags.
+func matchRunner(r gitlabRunner, filters []factFilter) bool {
+	attrs := map[string]string{
+		"id":          strconv.Itoa(r.Id),
+		"description": r.Description,
+		"ip":          r.IpAddress,
+		"status":      r.Status,
+		"online":      strconv.FormatBool(r.Online),
+		"paused":      strconv.FormatBool(r.Paused || (r.Active != nil && !*r.Active)),
+		"type":        r.RunnerType,
+	}
+
+	for _, f := range filters {
+		ok := strings.EqualFold(attrs[f.key], f.value)
+		if f.key == "tag" {
+			ok = false
+			for _, t := range r.TagList {
+				ok = ok || strings.EqualFold(t, f.value)
+			}
+		}
+
+		if ok == f.neg {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the runners matching the 'selector' conditions, e.g. "tag=windows,status=online".
+// Tags are fetched if 'details' is set or the conditions need them, only for the runners
+// matching the other conditions.
+func selectRunners(selector string, details bool) ([]gitlabRunner, error) {
+	filters, err := parseWhere(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := []factFilter{}
+	for _, f := range filters {
+		if f.key == "tag" {
+			details = true
+		} else {
+			listed = append(listed, f)
+		}
+	}
+
+	runners, err := gitlabRunners()
+	if err != nil {
+		return nil, err
+	}
+
+	match := func(runners []gitlabRunner, filters []factFilter) []gitlabRunner {
+		out := []gitlabRunner{}
+		for _, r := range runners {
+			if matchRunner(r, filters) {
+				out = append(out, r)
+			}
+		}
+
+		return out
+	}
+
+	runners = match(runners, listed)
+	if details {
+		if err := gitlabRunnerTags(runners); err != nil {
+			return nil, err
+		}
+	}
+
+	return match(runners, filters), nil
+}
+
+// Returns the hosts of the runners matching 'selector' (--gitlab-runners).
+func gitlabRunnerHosts(selector string) ([]string, error) {
+	runners, err := selectRunners(selector, false)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{}
+	for _, r := range runners {
+		hosts = append(hosts, runnerHost(r))
+	}
+
+	hosts = dedupe(hosts)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("No gitlab runners match '%s'.", selector)
+	}
+
+	return hosts, nil
+}
+
+// Add the hosts of the runners matching 'selector' to inventory 'group', keeping their
+// tags as inventory tags. With 'replace' the group keeps only the imported hosts, and the
+// tags of the hosts it drops go too unless another group lists them.
+func importGitlabRunners(invFile, group, selector string, replace bool) error {
+	runners, err := selectRunners(selector, true)
+	if err != nil {
+		return err
+	}
+
+	inv, err := loadInventory(invFile)
+	if err != nil {
+		return err
+	}
+
+	g, ok := inv.Groups[group]
+	if !ok || replace {
+		if g == nil {
+			g = &invGroup{}
+		}
+
+		for _, h := range g.Hosts {
+			listed := false
+			for name, other := range inv.Groups {
+				listed = listed || (name != group && containsString(other.Hosts, h))
+			}
+
+			if !listed {
+				delete(inv.Tags, h)
+			}
+		}
+
+		g.Hosts, inv.Groups[group] = []string{}, g
+	}
+
+	if inv.Tags == nil {
+		inv.Tags = map[string][]string{}
+	}
+
+	n := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tRUNNER\tDESCRIPTION\tSTATUS\tTAGS")
+	for _, r := range runners {
+		host := runnerHost(r)
+		if host == "" {
+			warnln("Skipping gitlab runner", r.Id, "without ip address or description.")
+			continue
+		}
+
+		tags := append([]string{}, r.TagList...)
+		sort.Strings(tags)
+		n++
+		g.Hosts = append(g.Hosts, host)
+		if len(tags) > 0 {
+			inv.Tags[host] = tags
+		} else {
+			delete(inv.Tags, host)
+		}
+
+		fmt.Fprintf(tw, "%s\t#%d\t%s\t%s\t%s\n", host, r.Id, r.Description, r.Status, strings.Join(tags, ","))
+	}
+
+	tw.Flush()
+	g.Hosts = dedupe(g.Hosts)
+	if dryRunOp(invFile, "import", fmt.Sprintf("%d host(s) into group '%s'", len(g.Hosts), group)) {
+		return nil
+	}
+
+	if err := saveInventory(invFile, inv); err != nil {
+		return err
+	}
+
+	infoln("Imported", n, "gitlab runner(s) into group", group, "of", invFile)
+	return nil
+}
+
+// Pause or resume runner 'id'. Both the 'paused' and the older 'active' attributes are
+// sent so it works across gitlab versions.
+func gitlabPause(id int, pause bool) error {
+	form := url.Values{
+		"paused": {strconv.FormatBool(pause)},
+		"active": {strconv.FormatBool(!pause)},
+	}
+
+	_, err := gitlabRequest("PUT", "/runners/"+strconv.Itoa(id), form, nil)
+	return err
+}
+
+// Returns the number of jobs running on runner 'id'.
+func gitlabRunningJobs(id int) (int, error) {
+	jobs := []json.RawMessage{}
+	_, err := gitlabRequest("GET", "/runners/"+strconv.Itoa(id)+"/jobs?status=running&per_page=100", nil, &jobs)
+	return len(jobs), err
+}
+
+// Pause the gitlab runner of 'host', wait until it has no running jobs, call 'fn', then
+// resume the runner (whatever the outcome of 'fn', unless it was paused already). Returns
+// the first error of the drain, 'fn' or the resume.
+func drainRunner(host string, timeout, interval time.Duration, fn func() error) (err error) {
+	log := withHost(host)
+	runners, err := gitlabRunners()
+	if err != nil {
+		log.errorln(err)
+		return err
+	}
+
+	r, err := gitlabRunnerOf(host, runners)
+	if err != nil {
+		log.errorln(err)
+		return err
+	}
+
+	id := "runner #" + strconv.Itoa(r.Id)
+	wasPaused := r.Paused || (r.Active != nil && !*r.Active)
+	if dryRunOp(host, "drain", id+" ("+r.Description+")") {
+		return fn()
+	}
+
+	if !wasPaused {
+		log.infoln("Pausing gitlab", id)
+		perr := gitlabPause(r.Id, true)
+		auditOp("gitlab-pause", host, id, perr)
+		if perr != nil {
+			log.errorln(perr)
+			return perr
+		}
+
+		defer func() {
+			log.infoln("Resuming gitlab", id)
+			rerr := gitlabPause(r.Id, false)
+			auditOp("gitlab-resume", host, id, rerr)
+			if rerr != nil {
+				log.errorln(rerr)
+				if err == nil {
+					err = rerr
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := gitlabRunningJobs(r.Id)
+		if err != nil {
+			log.errorln(err)
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("Gitlab %s still has %d running job(s) after %v.", id, n, timeout)
+			log.errorln(err)
+			return err
+		}
+
+		log.infoln("Waiting for", n, "running job(s) on gitlab", id)
+		time.Sleep(interval)
+	}
+
+	return fn()
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake GitLab API, recording the calls made. Like gitlab, runner tags are only in the
+// runner details.
+type fakeGitlab struct {
+	mu      sync.Mutex
+	runners []gitlabRunner
+	calls   []string
+
+	// Status codes to fail requests with, by "<method> <path>".
+	fail map[string]int
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+	call := r.Method + " " + path
+	f.calls = append(f.calls, call)
+	if code := f.fail[call]; code != 0 {
+		http.Error(w, "failed", code)
+		return
+	}
+
+	switch {
+	case call == "GET /runners/all":
+		list := []gitlabRunner{}
+		for _, runner := range f.runners {
+			runner.TagList = nil
+			list = append(list, runner)
+		}
+
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "GET" && strings.HasSuffix(path, "/jobs"):
+		w.Write([]byte("[]"))
+	case r.Method == "GET" && strings.HasPrefix(path, "/runners/"):
+		for _, runner := range f.runners {
+			if path == "/runners/"+strconv.Itoa(runner.Id) {
+				if runner.TagList == nil {
+					runner.TagList = []string{}
+				}
+
+				json.NewEncoder(w).Encode(runner)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+	case r.Method == "PUT" && strings.HasPrefix(path, "/runners/"):
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Route requests to gitlab.test to 'gl' and everything else to the fake holly 'holly'.
+func withFakeGitlab(t *testing.T, gl http.Handler, holly fakeHolly) {
+	saved := gitlab
+	gitlab.url, gitlab.token = "http://gitlab.test", "secret"
+	t.Cleanup(func() { gitlab = saved })
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		if r.URL.Host == "gitlab.test" {
+			w := httptest.NewRecorder()
+			gl.ServeHTTP(w, r)
+			return w.Code, w.Body.String()
+		}
+
+		return holly(r, body)
+	})
+}
+
+func TestUpdateRunnerDrainErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the local runner")
+	}
+
+	runner := filepath.Join(t.TempDir(), "runner")
+	if err := ioutil.WriteFile(runner, []byte("#!/bin/sh\necho 'Version:      2.0.0'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		fail     map[string]int
+		update   int
+		wantErr  bool
+		uploaded bool
+		resumed  bool
+	}{
+		{"ok", nil, 200, false, true, true},
+		{"update fails", nil, 500, true, true, true},
+		{"running jobs fail", map[string]int{"GET /runners/7/jobs": 500}, 200, true, false, true},
+		{"pause fails", map[string]int{"PUT /runners/7": 500}, 200, true, false, false},
+		{"no runners", map[string]int{"GET /runners/all": 500}, 200, true, false, false},
+	} {
+		gl := &fakeGitlab{runners: []gitlabRunner{{Id: 7, IpAddress: "h1"}}, fail: tt.fail}
+		var uploads execLog
+		withFakeGitlab(t, gl, func(r *http.Request, body string) (int, string) {
+			if strings.HasSuffix(r.URL.Path, "/update/runner") {
+				uploads.add(r.URL.Hostname(), "")
+				return tt.update, "update"
+			}
+
+			return 200, "Version:      1.0.0"
+		})
+
+		err := updateRunner("h1", runner, true, 0, 0)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+
+		if uploaded := len(uploads.cmds["h1"]) > 0; uploaded != tt.uploaded {
+			t.Errorf("%s: uploaded = %v, want %v", tt.name, uploaded, tt.uploaded)
+		}
+
+		// The first PUT pauses the runner, the second resumes it.
+		puts := 0
+		for _, c := range gl.calls {
+			if c == "PUT /runners/7" {
+				puts++
+			}
+		}
+
+		resumed := puts > 1
+
+		if resumed != tt.resumed {
+			t.Errorf("%s: resumed = %v, want %v (calls %v)", tt.name, resumed, tt.resumed, gl.calls)
+		}
+	}
+}
+
+func TestUpdateRunnerResumeFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the local runner")
+	}
+
+	runner := filepath.Join(t.TempDir(), "runner")
+	ioutil.WriteFile(runner, []byte("#!/bin/sh\necho 'Version:      2.0.0'\n"), 0755)
+	gl := &fakeGitlab{runners: []gitlabRunner{{Id: 7, IpAddress: "h1"}}}
+	withFakeGitlab(t, gl, func(r *http.Request, body string) (int, string) {
+		if strings.HasSuffix(r.URL.Path, "/update/runner") {
+			// Fail the resume that follows the update.
+			gl.mu.Lock()
+			gl.fail = map[string]int{"PUT /runners/7": 500}
+			gl.mu.Unlock()
+			return 200, "update"
+		}
+
+		return 200, "Version:      1.0.0"
+	})
+
+	if err := updateRunner("h1", runner, true, 0, 0); err == nil || !strings.Contains(err.Error(), "PUT /runners/7") {
+		t.Errorf("expected the resume error, got %v", err)
+	}
+}
+
+// Returns the number of calls made to 'call'.
+func (f *fakeGitlab) count(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == call {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestSelectRunnersDetails(t *testing.T) {
+	gl := &fakeGitlab{runners: []gitlabRunner{
+		{Id: 1, IpAddress: "h1", Status: "online", TagList: []string{"windows"}},
+		{Id: 2, IpAddress: "h2", Status: "offline", TagList: []string{"windows"}},
+		{Id: 3, IpAddress: "h3", Status: "online", TagList: []string{"linux"}},
+	}}
+
+	withFakeGitlab(t, gl, func(r *http.Request, body string) (int, string) { return 404, "" })
+	runners, err := selectRunners("status=online,tag=windows", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runners) != 1 || runners[0].Id != 1 {
+		t.Errorf("expected runner 1, got %+v", runners)
+	}
+
+	if n := gl.count("GET /runners/2"); n != 0 {
+		t.Errorf("details of the offline runner fetched %d time(s)", n)
+	}
+
+	if n := gl.count("GET /runners/1") + gl.count("GET /runners/3"); n != 2 {
+		t.Errorf("expected 2 detail requests for the online runners, got %d", n)
+	}
+
+	if _, err := selectRunners("status=online", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := gl.count("GET /runners/1"); n != 1 {
+		t.Errorf("details fetched without tag conditions")
+	}
+}
+
+func TestGitlabRunnerTagsNoConnLimit(t *testing.T) {
+	old := settings.maxConns
+	settings.maxConns = 0
+	defer func() { settings.maxConns = old }()
+	gl := &fakeGitlab{runners: []gitlabRunner{
+		{Id: 1, TagList: []string{"windows"}},
+		{Id: 2, TagList: []string{"linux"}},
+	}}
+
+	withFakeGitlab(t, gl, func(r *http.Request, body string) (int, string) { return 404, "" })
+	runners := []gitlabRunner{{Id: 1}, {Id: 2}}
+	done := make(chan error, 1)
+	go func() { done <- gitlabRunnerTags(runners) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("gitlabRunnerTags hangs with --max-conns-per-host 0")
+	}
+
+	if len(runners[0].TagList) != 1 || runners[1].TagList[0] != "linux" {
+		t.Errorf("expected the runner tags, got %+v", runners)
+	}
+}
+
+func TestImportGitlabRunnersReplace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts.yaml")
+	inv := "groups:\n  ci:\n    hosts: [old, shared, h1]\n  other:\n    hosts: [shared]\n" +
+		"tags:\n  old: [stale]\n  shared: [kept]\n  h1: [previous]\n"
+	if err := ioutil.WriteFile(file, []byte(inv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gl := &fakeGitlab{runners: []gitlabRunner{{Id: 1, IpAddress: "h1", TagList: []string{"windows"}}}}
+	withFakeGitlab(t, gl, func(r *http.Request, body string) (int, string) { return 404, "" })
+	if err := importGitlabRunners(file, "ci", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hosts := strings.Join(got.Groups["ci"].Hosts, ","); hosts != "h1" {
+		t.Errorf("ci hosts = %s, want h1", hosts)
+	}
+
+	want := map[string]string{"old": "", "shared": "kept", "h1": "windows"}
+	for host, tags := range want {
+		if g := strings.Join(got.Tags[host], ","); g != tags {
+			t.Errorf("tags of %s = %q, want %q", host, g, tags)
+		}
+	}
+}
+
+func TestShouldUpdateRunnerLocalVersionFails(t *testing.T) {
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) { return 200, "Version:      1.0.0" })
+	up, err := shouldUpdateRunner("h1", filepath.Join(t.TempDir(), "missing-runner"))
+	if err == nil || up {
+		t.Errorf("expected an error without update, got %v, %v", up, err)
+	}
+}
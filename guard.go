@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// Settings of the blast-radius guards, set from the global flags.
+var guard = struct {
+	yes          bool
+	threshold    int
+	confirmCount int
+}{threshold: 5}
+
+// Operations refused against protected inventory groups without --yes and the host count.
+// Playbooks are protected when they have exec, run or update-self steps.
+var protectedOps = map[string]bool{
+	"update self":       true,
+	"exec":              true,
+	"run":               true,
+	"runner restart":    true,
+	"runner register":   true,
+	"runner unregister": true,
+}
+
+// Answers to the guard's questions: --yes, the confirmed host count and whether the
+// operator can be prompted for them.
+type guardAnswers struct {
+	yes   bool
+	count int
+	tty   bool
+}
+
+// Global flags of the confirmation guards.
+func guardFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "yes, y",
+			Usage: "don't ask for confirmation",
+		},
+		cli.IntFlag{
+			Name:  "confirm-threshold",
+			Value: guard.threshold,
+			Usage: "ask for confirmation when a change targets more than `n` hosts",
+		},
+		cli.IntFlag{
+			Name:  "confirm-count",
+			Usage: "number of target `hosts`, required with --yes for protected groups when not on a terminal",
+		},
+	}
+}
+
+func setupGuard(c *cli.Context) {
+	guard.yes = c.GlobalBool("yes")
+	guard.threshold = c.GlobalInt("confirm-threshold")
+	guard.confirmCount = c.GlobalInt("confirm-count")
+}
+
+// Returns the answers given on the command line.
+func cliAnswers() guardAnswers {
+	return guardAnswers{yes: guard.yes, count: guard.confirmCount, tty: isTerminal(os.Stdin)}
+}
+
+// Returns the protected groups of the inventory 'file' containing any of 'hosts'.
+func protectedGroups(file string, hosts []string) ([]string, error) {
+	inv, err := loadInventory(file)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	for name, g := range inv.Groups {
+		if !g.Protected {
+			continue
+		}
+
+		for _, h := range g.Hosts {
+			if containsString(hosts, h) {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// Print 'question' and read the answer from stdin.
+func prompt(question string) string {
+	fmt.Fprint(os.Stderr, question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
+// Check that the command line answers allow 'op' against 'hosts' (see checkTargets).
+func confirmTargets(op string, hosts []string) error {
+	return checkTargets(op, protectedOps[op], hosts, settings.inventory, cliAnswers())
+}
+
+// Check that 'op' may run against 'hosts'. If 'protected', hosts in protected groups of
+// the inventory 'file' need --yes plus the host count, typed at the prompt or given with
+// --confirm-count; an unreadable inventory is refused without --yes. Other changes need
+// confirmation above the threshold unless --yes is set. Prompts only when 'a.tty' is set,
+// refusing instead.
+func checkTargets(op string, protected bool, hosts []string, file string, a guardAnswers) error {
+	if settings.dryRun {
+		return nil
+	}
+
+	n := len(hosts)
+	groups := []string{}
+	if protected {
+		var err error
+		groups, err = protectedGroups(file, hosts)
+		if err != nil && !a.yes {
+			return fmt.Errorf("Refusing '%s' without --yes, cannot check protected groups: %v", op, err)
+		}
+	}
+
+	if len(groups) > 0 {
+		if !a.yes {
+			return fmt.Errorf("Refusing '%s' on protected group(s) %s without --yes.", op, strings.Join(groups, ","))
+		}
+
+		count := a.count
+		if count == 0 && a.tty {
+			count, _ = strconv.Atoi(prompt(fmt.Sprintf("'%s' targets protected group(s) %s. Type the number of target hosts to continue: ",
+				op, strings.Join(groups, ","))))
+		}
+
+		if count != n {
+			return fmt.Errorf("Refusing '%s' on protected group(s) %s: host count not confirmed (%d targets).", op, strings.Join(groups, ","), n)
+		}
+
+		return nil
+	}
+
+	if a.yes || n <= guard.threshold {
+		return nil
+	}
+
+	if !a.tty {
+		return fmt.Errorf("Refusing '%s' on %d hosts (more than %d) without --yes.", op, n, guard.threshold)
+	}
+
+	preview := hosts
+	if len(preview) > 10 {
+		preview = append(append([]string{}, hosts[:10]...), "...")
+	}
+
+	answer := prompt(fmt.Sprintf("'%s' targets %d hosts: %s\nContinue? [y/N] ", op, n, strings.Join(preview, ",")))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("Cancelled '%s'.", op)
+	}
+
+	return nil
+}
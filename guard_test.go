@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns an inventory file with the protected group 'prod' (p1, p2) and the group 'dev'.
+func writeGuardInventory(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "hosts.yaml")
+	inv := "groups:\n  prod:\n    hosts: [p1, p2]\n    protected: true\n  dev:\n    hosts: [d1, d2]\n"
+	if err := ioutil.WriteFile(file, []byte(inv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestCheckTargets(t *testing.T) {
+	inv := writeGuardInventory(t)
+	broken := filepath.Join(t.TempDir(), "broken.yaml")
+	ioutil.WriteFile(broken, []byte("groups: [\n"), 0644)
+	many := []string{"d1", "d2", "d3", "d4", "d5", "d6"}
+	for _, tt := range []struct {
+		name      string
+		op        string
+		protected bool
+		hosts     []string
+		file      string
+		a         guardAnswers
+		refused   string
+	}{
+		{"protected without yes", "exec", true, []string{"p1", "d1"}, inv, guardAnswers{}, "protected group(s) prod"},
+		{"protected with yes, no count", "exec", true, []string{"p1"}, inv, guardAnswers{yes: true}, "not confirmed"},
+		{"protected with wrong count", "exec", true, []string{"p1", "p2"}, inv, guardAnswers{yes: true, count: 1}, "not confirmed"},
+		{"protected confirmed", "exec", true, []string{"p1", "p2"}, inv, guardAnswers{yes: true, count: 2}, ""},
+		{"unprotected op on protected group", "upload", false, []string{"p1"}, inv, guardAnswers{}, ""},
+		{"unprotected hosts", "exec", true, []string{"d1", "d2"}, inv, guardAnswers{}, ""},
+		{"above threshold without yes", "upload", false, many, inv, guardAnswers{}, "more than 5"},
+		{"above threshold with yes", "upload", false, many, inv, guardAnswers{yes: true}, ""},
+		{"broken inventory without yes", "exec", true, []string{"d1"}, broken, guardAnswers{}, "cannot check protected groups"},
+		{"broken inventory with yes", "exec", true, []string{"d1"}, broken, guardAnswers{yes: true}, ""},
+		{"broken inventory, unprotected op", "upload", false, []string{"d1"}, broken, guardAnswers{}, ""},
+	} {
+		err := checkTargets(tt.op, tt.protected, tt.hosts, tt.file, tt.a)
+		switch {
+		case tt.refused == "" && err != nil:
+			t.Errorf("%s: unexpected refusal: %v", tt.name, err)
+		case tt.refused != "" && (err == nil || !strings.Contains(err.Error(), tt.refused)):
+			t.Errorf("%s: got %v, want refusal mentioning %q", tt.name, err, tt.refused)
+		}
+	}
+}
+
+func TestCheckTargetsDryRun(t *testing.T) {
+	settings.dryRun = true
+	defer func() { settings.dryRun = false }()
+
+	if err := checkTargets("exec", true, []string{"p1"}, writeGuardInventory(t), guardAnswers{}); err != nil {
+		t.Errorf("dry runs are never refused, got %v", err)
+	}
+}
+
+func TestPlaybookProtected(t *testing.T) {
+	for _, tt := range []struct {
+		steps []playStep
+		want  bool
+	}{
+		{[]playStep{{Action: "upload"}, {Action: "stat"}}, false},
+		{[]playStep{{Action: "upload"}, {Action: "exec"}}, true},
+		{[]playStep{{Action: "run"}}, true},
+		{[]playStep{{Action: "update-self"}}, true},
+		{[]playStep{{Action: "update-conf"}}, false},
+		{[]playStep{{Action: "upload", OnFailure: []playStep{{Action: "exec"}}}}, true},
+	} {
+		pb := &playbook{Steps: tt.steps}
+		if got := pb.protected(); got != tt.want {
+			t.Errorf("%+v: protected() = %v, want %v", tt.steps, got, tt.want)
+		}
+	}
+}
+
+func TestGatewayProtectedExec(t *testing.T) {
+	var cmds execLog
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		cmds.add(r.URL.Hostname(), body)
+		return 200, "ok"
+	})
+
+	g := newTestGateway()
+	g.invFile = writeGuardInventory(t)
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"groups": ["prod"], "cmd": "hostname"}`, http.StatusForbidden},
+		{`{"groups": ["prod"], "cmd": "hostname", "yes": true}`, http.StatusForbidden},
+		{`{"groups": ["prod"], "cmd": "hostname", "yes": true, "confirmcount": 2}`, http.StatusOK},
+		{`{"groups": ["dev"], "cmd": "hostname"}`, http.StatusOK},
+	} {
+		r := httptest.NewRequest("POST", "/api/v1/exec", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		g.handleExec(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d: %s", tt.body, w.Code, tt.want, w.Body.String())
+		}
+	}
+
+	cmds.Lock()
+	defer cmds.Unlock()
+	if got := fmt.Sprint(len(cmds.cmds["p1"]), len(cmds.cmds["d1"])); got != "1 1" {
+		t.Errorf("expected one exec per host, got %v", cmds.cmds)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Headers whose values never appear in dumps or HAR files.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"Private-Token":       true,
+	"Job-Token":           true,
+}
+
+// Values never shown in dumped or recorded bodies, e.g. runner registration tokens sent
+// in exec commands. See redactValue.
+var redactedValues = struct {
+	sync.Mutex
+	list []string
+}{}
+
+// Hide 'v' in all dumps and HAR files from now on.
+func redactValue(v string) {
+	if v == "" {
+		return
+	}
+
+	redactedValues.Lock()
+	defer redactedValues.Unlock()
+	redactedValues.list = append(redactedValues.list, v)
+}
+
+// Returns 'b' with the redacted values replaced.
+func redactBody(b []byte) []byte {
+	redactedValues.Lock()
+	defer redactedValues.Unlock()
+	for _, v := range redactedValues.list {
+		b = bytes.Replace(b, []byte(v), []byte("[redacted]"), -1)
+	}
+
+	return b
+}
+
+// Round tripper that dumps requests and responses (--debug-http) and records them in a
+// HAR file (--har).
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+// Returns the first 'limit' bytes of a body of 'size' bytes starting with 'b', with
+// non-printable bytes shown as '.' so multipart layouts stay readable around binary parts.
+func dumpBody(b []byte, size int64, limit int) string {
+	more := ""
+	if len(b) > limit {
+		b = b[:limit]
+	}
+
+	if size > int64(len(b)) {
+		more = fmt.Sprintf("\n... (%d more bytes)", size-int64(len(b)))
+	}
+
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if (c < 0x20 || c > 0x7e) && c != '\r' && c != '\n' && c != '\t' {
+			c = '.'
+		}
+
+		out[i] = c
+	}
+
+	return string(out) + more
+}
+
+func headerLines(h http.Header) []harPair {
+	names := []string{}
+	for n := range h {
+		names = append(names, n)
+	}
+
+	sort.Strings(names)
+	out := []harPair{}
+	for _, n := range names {
+		for _, v := range h[n] {
+			if redactedHeaders[http.CanonicalHeaderKey(n)] {
+				v = "[redacted]"
+			}
+
+			out = append(out, harPair{Name: n, Value: v})
+		}
+	}
+
+	return out
+}
+
+// Write a dump to the log output, bypassing the log level.
+func writeDump(title string, first string, h http.Header, body []byte, size int64) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n%s\n", time.Now().Format("2006/01/02 15:04:05"), title, first)
+	for _, p := range headerLines(h) {
+		fmt.Fprintf(&b, "%s: %s\n", p.Name, p.Value)
+	}
+
+	if size > 0 {
+		fmt.Fprintf(&b, "\n%s\n", dumpBody(body, size, settings.debugBodyLimit))
+	}
+
+	logOut.Lock()
+	io.WriteString(logOut.w, b.String()+"\n")
+	logOut.Unlock()
+}
+
+func (t *debugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if r.Body != nil && r.GetBody != nil {
+		if rc, err := r.GetBody(); err == nil {
+			reqBody, _ = ioutil.ReadAll(rc)
+			reqBody = redactBody(reqBody)
+			rc.Close()
+		}
+	}
+
+	if settings.debugHttp {
+		writeDump(">>> request", r.Method+" "+r.URL.String()+" "+r.Proto, r.Header, reqBody, int64(len(reqBody)))
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	entry := newHarEntry(r, reqBody, start)
+	if err != nil {
+		if settings.debugHttp {
+			writeDump("<<< error", err.Error(), nil, nil, 0)
+		}
+
+		entry.Response.StatusText = err.Error()
+		recordHar(entry)
+		return nil, err
+	}
+
+	entry.Response.Status = resp.StatusCode
+	entry.Response.StatusText = http.StatusText(resp.StatusCode)
+	entry.Response.HttpVersion = resp.Proto
+	entry.Response.Headers = headerLines(resp.Header)
+	entry.Response.Content.MimeType = resp.Header.Get("Content-Type")
+	entry.Timings.Wait = msSince(start)
+
+	// Capture the body as it is read, so streamed responses keep streaming.
+	resp.Body = &capturingBody{ReadCloser: resp.Body, done: func(body []byte, n int64) {
+		body = redactBody(body)
+		if settings.debugHttp {
+			writeDump("<<< response", resp.Proto+" "+resp.Status, resp.Header, body, n)
+		}
+
+		entry.Time = msSince(start)
+		entry.Timings.Receive = entry.Time - entry.Timings.Wait
+		entry.Response.BodySize = n
+		entry.Response.Content.Size = n
+		if utf8.Valid(body) {
+			entry.Response.Content.Text = string(body)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+			entry.Response.Content.Encoding = "base64"
+		}
+
+		if int64(len(body)) < n {
+			entry.Response.Content.Comment = fmt.Sprintf("truncated to %d bytes", len(body))
+		}
+
+		recordHar(entry)
+	}}
+
+	return resp, nil
+}
+
+// Response body keeping the first bytes read (up to the HAR or dump limit) and calling
+// 'done' once on close.
+type capturingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	n    int64
+	once sync.Once
+	done func(body []byte, n int64)
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if keep := captureLimit() - b.buf.Len(); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+
+		b.buf.Write(p[:keep])
+	}
+
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *capturingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.buf.Bytes(), b.n) })
+	return err
+}
+
+// Bytes of each body kept: the dump limit, or 1MB when recording a HAR file.
+func captureLimit() int {
+	if settings.harFile != "" && settings.debugBodyLimit < 1<<20 {
+		return 1 << 20
+	}
+
+	return settings.debugBodyLimit
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
+
+// HAR 1.2 file layout (only the fields n1 fills in).
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	Url         string       `json:"url"`
+	HttpVersion string       `json:"httpVersion"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	Cookies     []harPair    `json:"cookies"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+	PostData    *harPostData `json:"postData,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HttpVersion string     `json:"httpVersion"`
+	Headers     []harPair  `json:"headers"`
+	Cookies     []harPair  `json:"cookies"`
+	Content     harContent `json:"content"`
+	RedirectUrl string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+func newHarEntry(r *http.Request, body []byte, start time.Time) *harEntry {
+	e := &harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      r.Method,
+			Url:         r.URL.String(),
+			HttpVersion: r.Proto,
+			Headers:     headerLines(r.Header),
+			QueryString: []harPair{},
+			Cookies:     []harPair{},
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		Response: harResponse{
+			Headers:     []harPair{},
+			Cookies:     []harPair{},
+			HeadersSize: -1,
+		},
+	}
+
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harPair{Name: k, Value: v})
+		}
+	}
+
+	if len(body) > 0 {
+		text := string(body)
+		if len(body) > captureLimit() || !utf8.Valid(body) {
+			text = dumpBody(body, int64(len(body)), captureLimit())
+		}
+
+		e.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: text}
+	}
+
+	return e
+}
+
+// Recorded HAR entries, kept in memory and written once when n1 exits (see writeHar).
+var harLog = struct {
+	sync.Mutex
+	entries []*harEntry
+}{}
+
+func recordHar(e *harEntry) {
+	if settings.harFile == "" {
+		return
+	}
+
+	harLog.Lock()
+	harLog.entries = append(harLog.entries, e)
+	harLog.Unlock()
+}
+
+// Write the recorded entries to the --har file.
+func writeHar() {
+	if settings.harFile == "" {
+		return
+	}
+
+	harLog.Lock()
+	defer harLog.Unlock()
+	har := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": name, "version": internalVersion},
+			"entries": harLog.entries,
+		},
+	}
+
+	b, _ := json.MarshalIndent(har, "", "  ")
+	if err := ioutil.WriteFile(settings.harFile, b, 0644); err != nil {
+		errorln(err)
+	}
+}
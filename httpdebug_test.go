@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHarWrittenOnce(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "n1.har")
+	saved := settings.harFile
+	settings.harFile = file
+	defer func() {
+		settings.harFile = saved
+		harLog.entries = nil
+	}()
+
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest("GET", "http://h1:8080/api/v1/version", nil)
+		recordHar(newHarEntry(r, nil, time.Now()))
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("HAR file written before exit: %v", err)
+	}
+
+	writeHar()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+
+	if err := json.Unmarshal(b, &har); err != nil {
+		t.Fatal(err)
+	}
+
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 3 {
+		t.Errorf("got version %q with %d entries, want 1.2 with 3", har.Log.Version, len(har.Log.Entries))
+	}
+}
+
+func TestDebugRedactsValues(t *testing.T) {
+	const token = "glrt-supersecret"
+	file := filepath.Join(t.TempDir(), "n1.har")
+	var dump bytes.Buffer
+	saved, savedLog := settings, logOut.w
+	settings.debugHttp, settings.harFile = true, file
+	logOut.w = &dump
+	defer func() {
+		settings, logOut.w = saved, savedLog
+		harLog.entries = nil
+		redactedValues.list = nil
+	}()
+
+	redactValue(token)
+	tr := &debugTransport{next: fakeHolly(func(r *http.Request, body string) (int, string) {
+		if !strings.Contains(body, token) {
+			t.Errorf("the request body sent must keep the token, got %q", body)
+		}
+
+		return 200, "Registering runner... succeeded with --token " + token
+	})}
+
+	client := &http.Client{Transport: tr}
+	resp, err := client.Post("http://h1:8080/api/v1/exec", "text/plain",
+		strings.NewReader("gitlab-runner register --token "+token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	writeHar()
+	har, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, out := range map[string]string{"dump": dump.String(), "har": string(har)} {
+		if strings.Contains(out, token) {
+			t.Errorf("%s shows the token:\n%s", name, out)
+		}
+
+		if !strings.Contains(out, "[redacted]") {
+			t.Errorf("%s has no redacted value:\n%s", name, out)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// Host inventory file layout. Hosts are listed per named group. Proxies can be set per
+// group or per host (see --proxy for the accepted urls). Protected groups refuse risky
+// operations without explicit confirmation (see confirmTargets). Tags are per host and
+// selected with --where tag=<tag>.
+type inventory struct {
+	Groups  map[string]*invGroup `yaml:"groups"`
+	Proxies map[string]string    `yaml:"proxies,omitempty"`
+	Tags    map[string][]string  `yaml:"tags,omitempty"`
+}
+
+type invGroup struct {
+	Hosts     []string `yaml:"hosts"`
+	Proxy     string   `yaml:"proxy,omitempty"`
+	Protected bool     `yaml:"protected,omitempty"`
+}
+
+// Load the inventory file. A missing file yields an empty inventory.
+func loadInventory(file string) (*inventory, error) {
+	inv := &inventory{Groups: map[string]*invGroup{}}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return inv, nil
+		}
+
+		errorln(err)
+		return nil, err
+	}
+
+	err = yaml.UnmarshalStrict(b, inv)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	if inv.Groups == nil {
+		inv.Groups = map[string]*invGroup{}
+	}
+
+	return inv, nil
+}
+
+// Write the inventory file. Comments in the file are not kept.
+func saveInventory(file string, inv *inventory) error {
+	b, err := yaml.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// Returns the hosts of a group. The "all" group contains every host in the inventory.
+func (inv *inventory) groupHosts(name string) ([]string, error) {
+	if g, ok := inv.Groups[name]; ok {
+		return g.Hosts, nil
+	}
+
+	if name == "all" {
+		names := []string{}
+		for n := range inv.Groups {
+			names = append(names, n)
+		}
+
+		sort.Strings(names)
+		hosts := []string{}
+		for _, n := range names {
+			hosts = append(hosts, inv.Groups[n].Hosts...)
+		}
+
+		return dedupe(hosts), nil
+	}
+
+	return nil, fmt.Errorf("Group '%s' not found in inventory.", name)
+}
+
+// Remove duplicate and empty entries, keeping the first occurrence.
+func dedupe(list []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, v := range list {
+		if v == "" || seen[v] {
+			continue
+		}
+
+		seen[v] = true
+		out = append(out, v)
+	}
+
+	return out
+}
+
+// Returns the inventory file, from the command's own --inventory flag if it has one and
+// it is set, or the global flag.
+func inventoryFile(c *cli.Context) string {
+	if c.IsSet("inventory") {
+		return c.String("inventory")
+	}
+
+	return c.GlobalString("inventory")
+}
+
+// Flags selecting target hosts by name and by inventory group.
+func hostsFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "hosts, host",
+			Value: "",
+			Usage: "list of target `host(s)`, separated by ',' (default: localhost)",
+		},
+		cli.StringFlag{
+			Name:  "group",
+			Value: "",
+			Usage: "list of inventory `group(s)`, separated by ','",
+		},
+		cli.StringFlag{
+			Name:  "where",
+			Value: "",
+			Usage: "only hosts whose facts (or inventory tags) match `conditions`, e.g. os=windows,arch=amd64,tag=gpu",
+		},
+		cli.StringFlag{
+			Name:  "gitlab-runners",
+			Value: "",
+			Usage: "add the hosts of the gitlab runners matching `conditions`, e.g. tag=windows,status=online",
+		},
+	}
+}
+
+// Returns the target hosts from --hosts, --group and --gitlab-runners, filtered by --where.
+// Defaults to localhost when none of them is set.
+func resolveHosts(c *cli.Context) ([]string, error) {
+	hosts := splitList(c.String("hosts"))
+	if sel := c.String("gitlab-runners"); sel != "" {
+		rh, err := gitlabRunnerHosts(sel)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts = append(hosts, rh...)
+	}
+
+	hosts, err := selectHosts(inventoryFile(c), hosts, splitList(c.String("group")), c.String("where"))
+	if err == nil {
+		dryRunHosts(hosts)
+	}
+
+	return hosts, err
+}
+
+// Returns 'hosts' plus the hosts of 'groups' in the inventory file, filtered by the
+// 'where' fact conditions. Defaults to localhost when both 'hosts' and 'groups' are empty.
+func selectHosts(invFile string, hosts, groups []string, where string) ([]string, error) {
+	hosts = append([]string{}, hosts...)
+	inv := &inventory{}
+	if len(groups) > 0 || where != "" {
+		var err error
+		inv, err = loadInventory(invFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(groups) > 0 {
+		for _, g := range groups {
+			gh, err := inv.groupHosts(g)
+			if err != nil {
+				errorln(err)
+				return nil, err
+			}
+
+			hosts = append(hosts, gh...)
+		}
+
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("No hosts in group(s): %s", strings.Join(groups, ","))
+		}
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+
+	hosts = dedupe(hosts)
+	if where != "" {
+		matched, err := filterHostsByFacts(hosts, where, defaultFactsTTL, inv.Tags)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("No hosts match '%s'.", where)
+		}
+
+		hosts = matched
+	}
+
+	return hosts, nil
+}
+
+func hostsCommand() cli.Command {
+	return cli.Command{
+		Name:  "hosts",
+		Usage: "manage the host inventory",
+		Subcommands: []cli.Command{
+			{
+				Name:  "import",
+				Usage: "import hosts into the inventory",
+				Subcommands: []cli.Command{
+					{
+						Name:  "gitlab",
+						Usage: "import the hosts of gitlab runners, with their tags (see --gitlab-host-by)",
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "group",
+								Value: "gitlab",
+								Usage: "inventory `group` of the imported hosts",
+							},
+							cli.StringFlag{
+								Name:  "select",
+								Value: "",
+								Usage: "only runners matching `conditions`, e.g. tag=windows,status=online",
+							},
+							cli.BoolFlag{
+								Name:  "replace",
+								Usage: "replace the group's hosts (and drop the tags of removed hosts) instead of adding to them",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							err := importGitlabRunners(c.GlobalString("inventory"), c.String("group"), c.String("select"), c.Bool("replace"))
+							if err != nil {
+								errorln(err)
+							}
+
+							return err
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(s, n) {
+			return logLevel(i), nil
+		}
+	}
+
+	return levelInfo, fmt.Errorf("Invalid log level '%s', expecting debug, info, warn or error.", s)
+}
+
+// Log output shared by all loggers. Every entry is written with a single Write under the
+// lock so lines from concurrent goroutines never interleave.
+var logOut = struct {
+	sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+}{w: os.Stderr, level: levelInfo}
+
+// A logger with context fields (key/value pairs) added to every entry.
+type logger struct {
+	fields []string
+}
+
+var rootLogger = &logger{}
+
+// Returns a logger with the 'key' field set to 'value'.
+func (l *logger) with(key, value string) *logger {
+	fields := append(append([]string{}, l.fields...), key, value)
+	return &logger{fields: fields}
+}
+
+// Returns a logger for messages about 'host'.
+func withHost(host string) *logger {
+	return rootLogger.with("host", host)
+}
+
+func (l *logger) log(level logLevel, v ...interface{}) {
+	logOut.Lock()
+	defer logOut.Unlock()
+	if level < logOut.level {
+		return
+	}
+
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	var line []byte
+	if logOut.json {
+		entry := map[string]string{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": logLevelNames[level],
+			"msg":   msg,
+		}
+
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			entry[l.fields[i]] = l.fields[i+1]
+		}
+
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(logLevelNames[level]))
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			b.WriteString(" [" + l.fields[i+1] + "]")
+		}
+
+		b.WriteString(" " + msg + "\n")
+		line = []byte(b.String())
+	}
+
+	logOut.w.Write(line)
+}
+
+func (l *logger) debugln(v ...interface{}) { l.log(levelDebug, v...) }
+func (l *logger) infoln(v ...interface{})  { l.log(levelInfo, v...) }
+func (l *logger) warnln(v ...interface{})  { l.log(levelWarn, v...) }
+func (l *logger) errorln(v ...interface{}) { l.log(levelError, v...) }
+
+func debugln(v ...interface{}) { rootLogger.log(levelDebug, v...) }
+func infoln(v ...interface{})  { rootLogger.log(levelInfo, v...) }
+func warnln(v ...interface{})  { rootLogger.log(levelWarn, v...) }
+func errorln(v ...interface{}) { rootLogger.log(levelError, v...) }
+
+// Print the response of a request to 'host' on stdout, keeping results apart from the
+// log output.
+func printResult(host, status string, body []byte) {
+	logOut.Lock()
+	defer logOut.Unlock()
+	out := strings.TrimRight(string(body), "\r\n")
+	if out != "" {
+		out = "\n" + out
+	}
+
+	fmt.Printf("[%s] %s%s\n", host, status, out)
+}
+
+// Global logging flags.
+func logFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "log debug messages",
+		},
+		cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "log errors only",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "",
+			Usage: "log `level`: debug, info, warn or error (overrides --verbose and --quiet)",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "log `format`: text or json",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Value: "",
+			Usage: "append logs to `file` instead of stderr",
+		},
+	}
+}
+
+// Configure the log output from the global flags.
+func setupLog(c *cli.Context) error {
+	level := levelInfo
+	switch {
+	case c.GlobalString("log-level") != "":
+		l, err := parseLogLevel(c.GlobalString("log-level"))
+		if err != nil {
+			return err
+		}
+
+		level = l
+	case c.GlobalBool("verbose"):
+		level = levelDebug
+	case c.GlobalBool("quiet"):
+		level = levelError
+	}
+
+	format := c.GlobalString("log-format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("Invalid log format '%s', expecting text or json.", format)
+	}
+
+	var w io.Writer = os.Stderr
+	if file := c.GlobalString("log-file"); file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		w = f
+	}
+
+	logOut.Lock()
+	logOut.w, logOut.level, logOut.json = w, level, format == "json"
+	logOut.Unlock()
+	return nil
+}
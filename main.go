@@ -5,15 +5,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -23,35 +25,26 @@ const (
 	internalVersion = "1.0"
 	usage           = "Client interface for 'holly' service."
 	copyright       = "(c) 2016 Chew Esmero."
-)
 
-func traceln(v ...interface{}) {
-	pc, _, _, _ := runtime.Caller(1)
-	fn := runtime.FuncForPC(pc)
-	fno := regexp.MustCompile(`^.*\.(.*)$`)
-	fnName := fno.ReplaceAllString(fn.Name(), "$1")
-	m := fmt.Sprintln(v...)
-	log.Print("["+fnName+"] ", m)
-}
+	// Runner binary location in the target hosts.
+	runnerPath = `c:\runner\gitlab-ci-multi-runner-windows-amd64.exe`
+)
 
 // Use http methods for the 'method' argument.
 // Returns the body, response status, and error.
 func httpOctetStream(method, url, data string) ([]byte, string, error) {
 	// Use byte as payload to accommodate all sorts of file naming weirdness.
 	var payload = []byte(data)
-	client := &http.Client{}
-	r, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
-	r.Header.Add("Content-Type", "application/octet-stream")
-	resp, err := client.Do(r)
+	resp, err := doRequest(newRequest(method, url, "application/octet-stream", payload))
 	if err != nil {
-		traceln(err)
+		errorln(err)
 		return nil, "", err
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		traceln(err)
+		errorln(err)
 		return nil, "", err
 	}
 
@@ -60,117 +53,172 @@ func httpOctetStream(method, url, data string) ([]byte, string, error) {
 
 // Returns the body, response status, and error.
 func uploadFileToEndpoint(url string, file string) ([]byte, string, error) {
+	files := []auditFile{auditFileDigest(file, "")}
+	if dryRunRequest("POST", url, files, "") {
+		return nil, dryRunStatus, nil
+	}
+
 	bodyBuf := &bytes.Buffer{}
 	var rs string
 	bodyWriter := multipart.NewWriter(bodyBuf)
 	fileWriter, err := bodyWriter.CreateFormFile("uploadfile", file)
 	if err != nil {
-		traceln(err)
+		errorln(err)
 		return nil, rs, err
 	}
 
 	fh, err := os.Open(file)
 	if err != nil {
-		traceln(err)
+		errorln(err)
 		return nil, rs, err
 	}
 
 	_, err = io.Copy(fileWriter, fh)
 	if err != nil {
-		traceln(err)
+		errorln(err)
 		return nil, rs, err
 	}
 
 	contentType := bodyWriter.FormDataContentType()
 	bodyWriter.Close()
-	resp, err := http.Post(url, contentType, bodyBuf)
+	resp, err := doRequest(newRequest("POST", url, contentType, bodyBuf.Bytes()))
 	if err != nil {
-		traceln(err)
+		errorln(err)
+		auditRequest(url, files, "", err)
 		return nil, rs, err
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	auditRequest(url, files, resp.Status, err)
 	return body, resp.Status, err
 }
 
-// Upload some file to some location (generic upload).
-func uploadFileGeneric(host string, file string, path string) error {
-	if host == "" {
-		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
-		traceln(err)
-		return err
-	}
-
-	if file == "" {
-		err := fmt.Errorf("No file provided. See --file flag for more info.")
-		traceln(err)
-		return err
+// Upload 'file' to 'path' in the target host using 'name' as the remote file name.
+// Returns the body, response status, and error.
+func uploadFileAs(host, file, name, path string) ([]byte, string, error) {
+	url := `http://` + host + `:8080/api/v1/upload`
+	// Holly stores the upload under the base name of the form file name.
+	base := name[strings.LastIndexAny(name, `\/`)+1:]
+	files := []auditFile{auditFileDigest(file, remoteJoin(remoteShell(path), path, base))}
+	if dryRunRequest("POST", url, files, "") {
+		return nil, dryRunStatus, nil
 	}
 
-	url := `http://` + host + `:8080/api/v1/upload`
 	bodyBuf := &bytes.Buffer{}
 	bodyWriter := multipart.NewWriter(bodyBuf)
-	fileWriter, err := bodyWriter.CreateFormFile("uploadfile", file)
+	fileWriter, err := bodyWriter.CreateFormFile("uploadfile", name)
 	if err != nil {
-		traceln(err)
-		return err
+		errorln(err)
+		return nil, "", err
 	}
 
 	fh, err := os.Open(file)
 	if err != nil {
-		traceln(err)
-		return err
+		errorln(err)
+		return nil, "", err
 	}
 
+	defer fh.Close()
 	_, err = io.Copy(fileWriter, fh)
 	if err != nil {
-		traceln(err)
-		return err
-	}
-
-	loc, err := bodyWriter.CreateFormField("path")
-	if err != nil {
-		traceln(err)
-		return err
+		errorln(err)
+		return nil, "", err
 	}
 
-	_, err = loc.Write([]byte(path))
+	err = bodyWriter.WriteField("path", path)
 	if err != nil {
-		traceln(err)
-		return err
+		errorln(err)
+		return nil, "", err
 	}
 
 	contentType := bodyWriter.FormDataContentType()
 	bodyWriter.Close()
-	resp, err := http.Post(url, contentType, bodyBuf)
+	resp, err := doRequest(newRequest("POST", url, contentType, bodyBuf.Bytes()))
 	if err != nil {
-		traceln(err)
-		return err
+		errorln(err)
+		auditRequest(url, files, "", err)
+		return nil, "", err
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	auditRequest(url, files, resp.Status, err)
+	return body, resp.Status, err
+}
+
+// Execute 'cmd' in 'host' and copy the output to 'w' as it arrives.
+// Returns the response status and error.
+func httpExecStream(host, cmd string, w io.Writer) (string, error) {
+	url := `http://` + host + `:8080/api/v1/exec`
+	resp, err := doRequest(newRequest("GET", url, "application/octet-stream", []byte(cmd)))
 	if err != nil {
-		traceln(err)
+		errorln(err)
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		errorln(err)
+		return resp.Status, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.Status, fmt.Errorf("Exec failed with status: %s", resp.Status)
+	}
+
+	return resp.Status, nil
+}
+
+// Returns an error if 'status' isn't a successful response to 'op'.
+func statusError(op, status string, body []byte) error {
+	if strings.HasPrefix(status, "200") {
+		return nil
+	}
+
+	return fmt.Errorf("%s failed with status: %s", op, strings.TrimSpace(status+" "+string(body)))
+}
+
+// Upload some file to some location (generic upload).
+func uploadFileGeneric(host string, file string, path string) error {
+	if host == "" {
+		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
+		errorln(err)
+		return err
+	}
+
+	if file == "" {
+		err := fmt.Errorf("No file provided. See --file flag for more info.")
+		errorln(err)
+		return err
+	}
+
+	body, status, err := uploadFileAs(host, file, file, path)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	printResult(host, status, body)
+	if err := statusError("Upload", status, body); err != nil {
+		errorln(err)
 		return err
 	}
 
-	str := fmt.Sprintf("%s", body)
-	traceln(str)
 	return nil
 }
 
 func httpSendUpdateService(host string, file string, reboot bool) error {
 	if host == "" {
 		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
-		traceln(err)
+		errorln(err)
 		return err
 	}
 
 	if file == "" {
 		err := fmt.Errorf("No file provided. See --file flag for more info.")
-		traceln(err)
+		errorln(err)
 		return err
 	}
 
@@ -180,76 +228,107 @@ func httpSendUpdateService(host string, file string, reboot bool) error {
 		url = url + `?reboot=false`
 	}
 
-	traceln("Start uploading " + file + " to " + url + ".")
+	withHost(host).infoln("Start uploading " + file + " to " + url + ".")
 	body, status, err := uploadFileToEndpoint(url, file)
 	if err != nil {
-		traceln(err)
+		errorln(err)
+		return err
+	}
+
+	printResult(host, status, body)
+	if err := statusError("Update", status, body); err != nil {
+		errorln(err)
 		return err
 	}
 
-	traceln("[" + host + "]")
-	traceln(status)
-	traceln(string(body))
 	return nil
 }
 
-func shouldUpdateRunner(host, runner string) bool {
-	// Read current runner version.
-	err := httpSendExecCmd(host,
-		`c:\runner\gitlab-ci-multi-runner-windows-amd64.exe -v`,
-		os.TempDir()+`\gv.txt`,
-		false,
-		true,
-		10000)
+// Extract the version number from the output of 'runner -v'.
+func extractRunnerVersion(out []byte) string {
+	re := regexp.MustCompile(`Version:\s+\d+\.\d+\.\d+`)
+	hv := re.Find(out)
+	hvs := strings.Split(string(hv), " ")
+	return strings.TrimSpace(hvs[len(hvs)-1])
+}
 
+// Returns the version of the runner installed in 'host'.
+func remoteRunnerVersion(host, runner string) (string, error) {
+	body, status, err := httpExec(host, runner+` -v`, false, true, 10000)
 	if err != nil {
-		traceln(err)
-		return false
+		errorln(err)
+		return "", err
 	}
 
-	hostver, err := ioutil.ReadFile(os.TempDir() + `\gv.txt`)
-	if err != nil {
-		traceln(err)
-		return false
+	if !strings.HasPrefix(status, "200") {
+		return "", fmt.Errorf("Runner version failed with status: %s", status)
 	}
 
-	fnExtractVer := func(input []byte) string {
-		re := regexp.MustCompile(`Version:\s+\d+\.\d+\.\d+`)
-		hv := re.Find(hostver)
-		hvs := strings.Split(string(hv), " ")
-		hvval := strings.TrimSpace(hvs[len(hvs)-1])
-		return string(hvval)
+	return extractRunnerVersion(body), nil
+}
+
+// Returns true if the runner in 'host' differs from the local 'runner' binary.
+func shouldUpdateRunner(host, runner string) (bool, error) {
+	// Read current runner version.
+	oldv, err := remoteRunnerVersion(host, runnerPath)
+	if err != nil {
+		errorln(err)
+		return false, err
 	}
 
 	// Get version of the newly downloaded runner.
 	cmd := exec.Command(runner, "-v")
 	con, err := cmd.Output()
-	oldv := fnExtractVer(hostver)
-	newv := fnExtractVer(con)
-	traceln("Current runner version:", oldv)
-	traceln("New runner version:", newv)
+	newv := extractRunnerVersion(con)
+	if err != nil || newv == "" {
+		err := fmt.Errorf("Cannot get the version of %s: %v", runner, err)
+		withHost(host).errorln(err)
+		return false, err
+	}
+
+	withHost(host).infoln("Current runner version:", oldv)
+	withHost(host).infoln("New runner version:", newv)
 	if oldv == newv {
-		traceln(host, "runner is already in the latest version.")
-		return false
+		withHost(host).infoln("Runner is already in the latest version.")
+		dryRunOp(host, "skip", "runner update, already at "+oldv)
+		return false, nil
 	}
 
-	return true
+	dryRunOp(host, "update", "runner "+oldv+" -> "+newv)
+
+	return true, nil
+}
+
+// Update the runner in 'host' to the local 'file' unless it is at that version already.
+// With 'drain', its gitlab runner is paused until the update is done (see drainRunner).
+func updateRunner(host, file string, drain bool, timeout, interval time.Duration) error {
+	up, err := shouldUpdateRunner(host, file)
+	if err != nil || !up {
+		return err
+	}
+
+	update := func() error { return httpSendUpdateRunner(host, file) }
+	if drain {
+		return drainRunner(host, timeout, interval, update)
+	}
+
+	return update()
 }
 
 func httpSendUpdateRunner(host string, file string) error {
 	if host == "" {
 		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
-		traceln(err)
+		errorln(err)
 		return err
 	}
 
 	upfile := file
 	if file == "" {
 		// If no file provided, we download the runner to tempdir.
-		traceln("Download latest runner to tempdir:", os.TempDir())
+		infoln("Download latest runner to tempdir:", os.TempDir())
 		f, err := downloadRunner(os.TempDir(), "")
 		if err != nil {
-			traceln(err)
+			errorln(err)
 			return err
 		}
 
@@ -257,47 +336,54 @@ func httpSendUpdateRunner(host string, file string) error {
 	}
 
 	url := `http://` + host + `:8080/api/v1/update/runner`
-	traceln("Start uploading " + upfile + " to " + url + ".")
+	withHost(host).infoln("Start uploading " + upfile + " to " + url + ".")
 	body, status, err := uploadFileToEndpoint(url, upfile)
 	if err != nil {
-		traceln(err)
+		errorln(err)
+		return err
+	}
+
+	printResult(host, status, body)
+	if err := statusError("Runner update", status, body); err != nil {
+		errorln(err)
 		return err
 	}
 
-	traceln("[" + host + "]")
-	traceln(status)
-	traceln(string(body))
 	return nil
 }
 
 func httpSendUpdateConf(host string, file string) error {
 	if host == "" {
 		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
-		traceln(err)
+		errorln(err)
 		return err
 	}
 
 	if file == "" {
 		err := fmt.Errorf("No file provided. See --file flag for more info.")
-		traceln(err)
+		errorln(err)
 		return err
 	}
 
 	url := `http://` + host + `:8080/api/v1/update/conf`
-	traceln("Start uploading " + file + " to " + url + ".")
+	withHost(host).infoln("Start uploading " + file + " to " + url + ".")
 	body, status, err := uploadFileToEndpoint(url, file)
 	if err != nil {
-		traceln(err)
+		errorln(err)
+		return err
+	}
+
+	printResult(host, status, body)
+	if err := statusError("Config update", status, body); err != nil {
+		errorln(err)
 		return err
 	}
 
-	traceln("[" + host + "]")
-	traceln(status)
-	traceln(string(body))
 	return nil
 }
 
-func httpSendExecCmd(host, cmd, outFile string, interactive, wait bool, waitms int) error {
+// Returns the exec endpoint url of 'host' with the given options.
+func execUrl(host string, interactive, wait bool, waitms int) string {
 	url := `http://` + host + `:8080/api/v1/exec`
 	if interactive {
 		url = url + `?interactive=true`
@@ -310,71 +396,66 @@ func httpSendExecCmd(host, cmd, outFile string, interactive, wait bool, waitms i
 		url = url + `&waitms=` + fmt.Sprintf("%d", waitms)
 	}
 
-	body, status, err := httpOctetStream("GET", url, cmd)
-	if err != nil {
-		traceln(err)
-		return err
-	}
+	return url
+}
 
-	traceln(status)
-	traceln(string(body))
-	if outFile != "" {
-		err := ioutil.WriteFile(outFile, body, 0644)
-		if err != nil {
-			traceln(err)
-			return err
-		}
+// Returns the body, response status, and error.
+func httpExec(host, cmd string, interactive, wait bool, waitms int) ([]byte, string, error) {
+	return httpOctetStream("GET", execUrl(host, interactive, wait, waitms), cmd)
+}
+
+// Execute 'cmd', which changes 'host': skipped by --dry-run and recorded in the audit log.
+func httpExecChange(op, host, cmd string, interactive, wait bool, waitms int) ([]byte, string, error) {
+	if dryRunRequest("GET", execUrl(host, interactive, wait, waitms), nil, cmd) {
+		return nil, dryRunStatus, nil
 	}
 
-	return nil
+	body, status, err := httpExec(host, cmd, interactive, wait, waitms)
+	auditExec(op, host, cmd, status, err)
+	return body, status, err
 }
 
-func httpGetFileStats(host string, fileList string, outFile string) error {
-	url := `http://` + host + `:8080/api/v1/filestat`
-	body, status, err := httpOctetStream("GET", url, fileList)
+func httpSendExecCmd(host, cmd, outFile string, interactive, wait bool, waitms int) error {
+	body, status, err := httpExecChange("exec", host, cmd, interactive, wait, waitms)
 	if err != nil {
-		traceln(err)
+		errorln(err)
 		return err
 	}
 
-	traceln(status)
-	traceln(string(body))
-	if outFile != "" {
+	printResult(host, status, body)
+	if outFile != "" && status != dryRunStatus {
 		err := ioutil.WriteFile(outFile, body, 0644)
 		if err != nil {
-			traceln(err)
+			errorln(err)
 			return err
 		}
 	}
 
-	return nil
+	return statusError("Exec", status, nil)
 }
 
-func httpReadFile(host string, file string, outFile string) error {
-	url := `http://` + host + `:8080/api/v1/readfile`
-	body, status, err := httpOctetStream("GET", url, file)
+// Returns the body, response status, and error.
+func httpGetVersion(host string) ([]byte, string, error) {
+	resp, err := doRequest(newRequest("GET", `http://`+host+`:8080/api/v1/version`, "", nil))
 	if err != nil {
-		traceln(err)
-		return err
+		errorln(err)
+		return nil, "", err
 	}
 
-	traceln(status)
-	traceln(string(body))
-	if outFile != "" {
-		err := ioutil.WriteFile(outFile, body, 0644)
-		if err != nil {
-			traceln(err)
-			return err
-		}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		errorln(err)
+		return nil, "", err
 	}
 
-	return nil
+	return body, resp.Status, nil
 }
 
 // Returns the filename when download succeeds.
 func downloadRunner(targetDir string, fileUrl string) (string, error) {
 	if targetDir == "" {
-		traceln("Please provide a target directory.")
+		errorln("Please provide a target directory.")
 		return "", nil
 	}
 
@@ -384,7 +465,7 @@ func downloadRunner(targetDir string, fileUrl string) (string, error) {
 		url = `https://gitlab-ci-multi-runner-downloads.s3.amazonaws.com/latest/binaries/gitlab-ci-multi-runner-windows-amd64.exe`
 	}
 
-	resp, err := http.Get(url)
+	resp, err := doRequest(newRequest("GET", url, "", nil))
 	if err != nil {
 		return "", err
 	}
@@ -392,12 +473,12 @@ func downloadRunner(targetDir string, fileUrl string) (string, error) {
 	defer resp.Body.Close()
 	_, f := filepath.Split(url)
 	if len(f) == 0 {
-		traceln("Cannot determine filename from url.")
+		errorln("Cannot determine filename from url.")
 		return "", nil
 	}
 
 	fp := targetDir + `\` + f
-	traceln("target:", fp)
+	infoln("target:", fp)
 	out, err := os.Create(fp)
 	if err != nil {
 		return "", err
@@ -418,71 +499,120 @@ func main() {
 	app.Usage = usage
 	app.Version = internalVersion
 	app.Copyright = copyright
-	app.Commands = []cli.Command{
-		{
-			Name:  "runner",
-			Usage: "download gitlab runner",
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:  "dir",
-					Value: "",
-					Usage: "target directory",
-				},
-				cli.StringFlag{
-					Name:  "url",
-					Value: "",
-					Usage: "file url to download (default: 64bit runner)",
-				},
-			},
-			Action: func(c *cli.Context) error {
-				_, err := downloadRunner(c.String("dir"), c.String("url"))
-				return err
-			},
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "inventory",
+			Value:  "hosts.yaml",
+			Usage:  "inventory `file` with host groups",
+			EnvVar: "N1_INVENTORY",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the changes commands would make without sending them (read-only probes still run)",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			Value:  defaultAuditFile(),
+			Usage:  "audit log `file` of mutating operations, empty to disable",
+			EnvVar: "N1_AUDIT_LOG",
 		},
+	}
+
+	app.Flags = append(app.Flags, configFlags()...)
+	app.Flags = append(app.Flags, logFlags()...)
+	app.Flags = append(app.Flags, guardFlags()...)
+	app.Flags = append(app.Flags, gitlabFlags()...)
+	app.Flags = append(app.Flags, clientFlags()...)
+	app.Before = func(c *cli.Context) error {
+		if err := setupConfig(c); err != nil {
+			errorln(err)
+			return err
+		}
+
+		if err := setupLog(c); err != nil {
+			errorln(err)
+			return err
+		}
+
+		auditFileName = c.GlobalString("audit-log")
+		settings.dryRun = c.GlobalBool("dry-run")
+		setupGuard(c)
+		setupGitlab(c)
+		return setupClient(c)
+	}
+
+	app.Commands = []cli.Command{
+		runnerCommand(),
 		{
 			Name:  "update",
 			Usage: "update 'holly' module(s)",
-			Flags: []cli.Flag{
+			Flags: append(hostsFlags(),
 				cli.StringFlag{
 					Name:  "file",
 					Value: "",
 					Usage: "`file` to upload ([runner] option: download latest x64 when empty)",
 				},
-				cli.StringFlag{
-					Name:  "hosts",
-					Value: "localhost",
-					Usage: "list of target `host(s)`, separated by ','",
-				},
 				cli.BoolFlag{
 					Name:  "reboot",
 					Usage: "should reboot after update (default: true for [self] option)",
 				},
-			},
+				cli.BoolFlag{
+					Name:  "drain",
+					Usage: "[runner] option: pause the gitlab runner and wait for running jobs before updating",
+				},
+				cli.DurationFlag{
+					Name:  "drain-timeout",
+					Value: time.Hour,
+					Usage: "give up waiting for running jobs after `duration`",
+				},
+				cli.DurationFlag{
+					Name:  "drain-interval",
+					Value: 30 * time.Second,
+					Usage: "poll running jobs every `duration`",
+				},
+			),
 			ArgsUsage: "[self|runner|conf]",
 			Action: func(c *cli.Context) error {
+				hosts := []string{}
+				failed := []string{}
 				if c.NArg() > 0 {
+					switch c.Args().Get(0) {
+					case "self", "runner", "conf":
+						var err error
+						hosts, err = resolveHosts(c)
+						if err != nil {
+							errorln(err)
+							return err
+						}
+
+						if err := confirmTargets("update "+c.Args().Get(0), hosts); err != nil {
+							errorln(err)
+							return err
+						}
+					}
+
 					switch c.Args().Get(0) {
 					case "self":
-						hosts := strings.Split(c.String("hosts"), ",")
 						for _, host := range hosts {
 							reboot := true
 							if c.IsSet("reboot") && c.Bool("reboot") == false {
 								reboot = false
 							}
 
-							traceln("Start update service request for " + host + ".")
-							httpSendUpdateService(host, c.String("file"), reboot)
+							infoln("Start update service request for " + host + ".")
+							if err := httpSendUpdateService(host, c.String("file"), reboot); err != nil {
+								failed = append(failed, host)
+							}
 						}
 					case "runner":
-						hosts := strings.Split(c.String("hosts"), ",")
 						file := c.String("file")
 						// If no file provided, we download the runner to tempdir. We are running
 						// as service so most likely, in c:\windows\temp folder.
 						if file == "" {
-							traceln("Download latest runner to tempdir:", os.TempDir())
+							infoln("Download latest runner to tempdir:", os.TempDir())
 							f, err := downloadRunner(os.TempDir(), "")
 							if err != nil {
-								traceln(err)
+								errorln(err)
 								return err
 							}
 
@@ -490,23 +620,29 @@ func main() {
 						}
 
 						for _, host := range hosts {
-							traceln("Start update runner request for " + host + ".")
-							if up := shouldUpdateRunner(host, file); up {
-								httpSendUpdateRunner(host, file)
+							infoln("Start update runner request for " + host + ".")
+							err := updateRunner(host, file, c.Bool("drain"), c.Duration("drain-timeout"), c.Duration("drain-interval"))
+							if err != nil {
+								failed = append(failed, host)
 							}
 						}
 					case "conf":
-						hosts := strings.Split(c.String("hosts"), ",")
 						for _, host := range hosts {
-							traceln("Start update config request for " + host + ".")
-							httpSendUpdateConf(host, c.String("file"))
+							infoln("Start update config request for " + host + ".")
+							if err := httpSendUpdateConf(host, c.String("file")); err != nil {
+								failed = append(failed, host)
+							}
 						}
 					default:
-						traceln("Valid argument is either 'self' or 'runner' or none.")
+						errorln("Valid argument is either 'self' or 'runner' or none.")
 						return nil
 					}
 				} else {
-					traceln("No arguments provided.")
+					errorln("No arguments provided.")
+				}
+
+				if len(failed) > 0 {
+					return fmt.Errorf("Update failed on: %s", strings.Join(failed, ","))
 				}
 
 				return nil
@@ -514,52 +650,90 @@ func main() {
 		},
 		{
 			Name:  "upload",
-			Usage: "update file to 'holly'",
-			Flags: []cli.Flag{
-				cli.StringFlag{
+			Usage: "update file(s) to 'holly'",
+			Flags: append(hostsFlags(),
+				cli.StringSliceFlag{
 					Name:  "file",
+					Usage: "`file` to upload as 'src[:dest]', dest is a directory (the file keeps its name), can be a glob, repeat for more files",
+				},
+				cli.StringFlag{
+					Name:  "manifest",
 					Value: "",
-					Usage: "new `file` to upload",
+					Usage: "yaml `file` with a list of 'src' and 'dest' pairs",
 				},
 				cli.StringFlag{
 					Name:  "path",
 					Value: "root",
-					Usage: "file destination path",
+					Usage: "default file destination path",
 				},
-				cli.StringFlag{
-					Name:  "host",
-					Value: "localhost",
-					Usage: "upload destination host",
-				},
-			},
+			),
 			Action: func(c *cli.Context) error {
-				if !c.IsSet("file") {
-					traceln("Flag 'file' not set.")
+				if !c.IsSet("file") && !c.IsSet("manifest") {
+					errorln("Flag 'file' or 'manifest' not set.")
 					return nil
 				}
 
-				// Todo: support list of hosts as target, and list of file-path pairs.
-				return uploadFileGeneric(c.String("host"), c.String("file"), c.String("path"))
+				items := []uploadItem{}
+				for _, f := range c.StringSlice("file") {
+					items = append(items, splitUploadPair(f, c.String("path")))
+				}
+
+				if c.IsSet("manifest") {
+					mi, err := loadUploadManifest(c.String("manifest"), c.String("path"))
+					if err != nil {
+						errorln(err)
+						return err
+					}
+
+					items = append(items, mi...)
+				}
+
+				items, err := expandUploadItems(items)
+				if err != nil {
+					errorln(err)
+					return err
+				}
+
+				hosts, err := resolveHosts(c)
+				if err != nil {
+					errorln(err)
+					return err
+				}
+
+				if err := confirmTargets("upload", hosts); err != nil {
+					errorln(err)
+					return err
+				}
+
+				results := uploadFiles(hosts, items)
+				printUploadResults(results)
+				failed := 0
+				for _, r := range results {
+					if r.err != nil {
+						failed++
+					}
+				}
+
+				if failed > 0 {
+					return fmt.Errorf("%d of %d upload(s) failed.", failed, len(results))
+				}
+
+				return nil
 			},
 		},
 		{
 			Name:  "exec",
 			Usage: "remote execute command",
-			Flags: []cli.Flag{
+			Flags: append(hostsFlags(),
 				cli.StringFlag{
 					Name:  "cmd",
 					Value: "",
 					Usage: "`command` to execute",
 				},
-				cli.StringFlag{
-					Name:  "host",
-					Value: "localhost",
-					Usage: "target `host`",
-				},
 				cli.StringFlag{
 					Name:  "out",
 					Value: "",
-					Usage: "write output to `file`",
+					Usage: "write output to `file` (<file>.<host> for multiple hosts)",
 				},
 				cli.BoolFlag{
 					Name:  "interactive",
@@ -574,10 +748,10 @@ func main() {
 					Value: 5000,
 					Usage: "wait `timeout` in ms",
 				},
-			},
+			),
 			Action: func(c *cli.Context) error {
 				if !c.IsSet("cmd") {
-					traceln("Flag 'cmd' not set.")
+					errorln("Flag 'cmd' not set.")
 					return nil
 				}
 
@@ -591,102 +765,237 @@ func main() {
 					wait = c.Bool("wait")
 				}
 
-				// Todo: support list of hosts as target.
-				return httpSendExecCmd(c.String("host"), c.String("cmd"), c.String("out"), interactive, wait, c.Int("waitms"))
+				hosts, err := resolveHosts(c)
+				if err != nil {
+					errorln(err)
+					return err
+				}
+
+				if err := confirmTargets("exec", hosts); err != nil {
+					errorln(err)
+					return err
+				}
+
+				failed := []string{}
+				for _, host := range hosts {
+					out := c.String("out")
+					if out != "" && len(hosts) > 1 {
+						out = out + "." + host
+					}
+
+					if err := httpSendExecCmd(host, c.String("cmd"), out, interactive, wait, c.Int("waitms")); err != nil {
+						failed = append(failed, host)
+					}
+				}
+
+				if len(failed) > 0 {
+					return fmt.Errorf("Exec failed on: %s", strings.Join(failed, ","))
+				}
+
+				return nil
 			},
 		},
 		{
 			Name:  "stat",
 			Usage: "get file stats",
-			Flags: []cli.Flag{
+			Flags: append(hostsFlags(),
 				cli.StringFlag{
 					Name:  "files",
 					Value: "",
 					Usage: "comma-separated file list",
 				},
-				cli.StringFlag{
-					Name:  "host",
-					Value: "localhost",
-					Usage: "target `host`",
-				},
 				cli.StringFlag{
 					Name:  "out",
 					Value: "",
-					Usage: "write output to `file`",
+					Usage: "write output as json to `file`",
 				},
-			},
+				cli.StringSliceFlag{
+					Name:  "assert",
+					Usage: "fail unless every file passes `check`: exists, missing, size>N, version>=X, hash=H",
+				},
+				cli.BoolFlag{
+					Name:  "compare",
+					Usage: "fail if a host's files differ from the majority of hosts",
+				},
+			),
 			Action: func(c *cli.Context) error {
 				if !c.IsSet("files") {
-					traceln("Flag 'files' not set.")
+					errorln("Flag 'files' not set.")
 					return fmt.Errorf("Flag 'files' not set.")
 				}
 
-				// Todo: support list of hosts as target.
-				return httpGetFileStats(c.String("host"), c.String("files"), c.String("out"))
+				hosts, err := resolveHosts(c)
+				if err != nil {
+					errorln(err)
+					return err
+				}
+
+				files := splitList(c.String("files"))
+				return statFiles(hosts, files, c.StringSlice("assert"), c.Bool("compare"), c.String("out"))
 			},
 		},
 		{
 			Name:  "read",
-			Usage: "read a file",
-			Flags: []cli.Flag{
+			Usage: "read a file, or download a directory",
+			Flags: append(hostsFlags(),
 				cli.StringFlag{
 					Name:  "file",
 					Value: "",
-					Usage: "file to read",
+					Usage: "file to read (directory with --recursive, glob patterns allowed)",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Value: "",
+					Usage: "write output to `file` (default: stdout, <file>.<host> for multiple hosts)",
+				},
+				cli.Int64Flag{
+					Name:  "offset",
+					Usage: "start reading at byte `offset` (negative: from the end)",
+				},
+				cli.Int64Flag{
+					Name:  "length",
+					Usage: "read at most `n` bytes (default: to the end)",
+				},
+				cli.IntFlag{
+					Name:  "tail",
+					Value: 10,
+					Usage: "output the last `n` lines",
+				},
+				cli.BoolFlag{
+					Name:  "follow",
+					Usage: "keep printing data appended to the file, like 'tail -f'",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: time.Second,
+					Usage: "poll `interval` for --follow",
+				},
+				cli.BoolFlag{
+					Name:  "recursive",
+					Usage: "download all files under the directory",
 				},
 				cli.StringFlag{
-					Name:  "host",
-					Value: "localhost",
-					Usage: "target `host`",
+					Name:  "outdir",
+					Value: ".",
+					Usage: "local `dir` for downloaded files, stored as <outdir>/<host>/...",
 				},
 				cli.StringFlag{
-					Name:  "out",
+					Name:  "archive",
 					Value: "",
-					Usage: "write output to `file`",
+					Usage: "fetch the directory as a zip or tar.gz `format` archive and extract it",
 				},
-			},
+			),
+			ArgsUsage: "[file|dir]",
 			Action: func(c *cli.Context) error {
-				if !c.IsSet("file") {
-					traceln("Flag 'file' not set.")
+				file := c.String("file")
+				if file == "" {
+					file = c.Args().Get(0)
+				}
+
+				if file == "" {
+					errorln("Flag 'file' not set.")
 					return fmt.Errorf("Flag 'file' not set.")
 				}
 
-				// Todo: support list of hosts as target.
-				return httpReadFile(c.String("host"), c.String("file"), c.String("out"))
-			},
-		},
-		{
-			Name:  "version",
-			Usage: "get 'holly' version",
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:  "host",
-					Value: "localhost",
-					Usage: "target `host`",
-				},
-			},
-			Action: func(c *cli.Context) error {
-				client := &http.Client{}
-				r, _ := http.NewRequest("GET", `http://`+c.String("host")+`:8080/api/v1/version`, nil)
-				resp, err := client.Do(r)
-				if err != nil {
-					traceln(err)
-					return err
+				o := &readOptions{
+					offset:   c.Int64("offset"),
+					length:   c.Int64("length"),
+					follow:   c.Bool("follow"),
+					interval: c.Duration("interval"),
 				}
 
-				defer resp.Body.Close()
-				body, err := ioutil.ReadAll(resp.Body)
+				if c.IsSet("tail") || o.follow {
+					o.tail = c.Int("tail")
+				}
+
+				hosts, err := resolveHosts(c)
 				if err != nil {
-					traceln(err)
+					errorln(err)
 					return err
 				}
 
-				traceln(resp.Status)
-				traceln(string(body))
+				read := func(host string) error {
+					dir, pattern := splitRemoteGlob(remoteShell(file), file)
+					switch {
+					case c.IsSet("archive"):
+						return readArchive(host, file, c.String("archive"), c.String("outdir"))
+					case c.Bool("recursive"), pattern != "":
+						return readTree(host, dir, pattern, c.String("outdir"))
+					}
+
+					w, done, err := readOutput(c.String("out"), host, len(hosts) > 1)
+					if err != nil {
+						errorln(err)
+						return err
+					}
+
+					defer done()
+					return readStream(host, file, o, w)
+				}
+
+				var mu sync.Mutex
+				var wg sync.WaitGroup
+				failed := []string{}
+				for _, host := range hosts {
+					wg.Add(1)
+					fn := func(host string) {
+						defer wg.Done()
+						if err := read(host); err != nil {
+							mu.Lock()
+							failed = append(failed, host)
+							mu.Unlock()
+						}
+					}
+
+					// Followed files are watched concurrently, everything else one host at a time.
+					if o.follow {
+						go fn(host)
+					} else {
+						fn(host)
+					}
+				}
+
+				wg.Wait()
+				if len(failed) > 0 {
+					return fmt.Errorf("Read failed on: %s", strings.Join(failed, ","))
+				}
+
 				return nil
 			},
 		},
-	}
+		versionCommand(),
+		runCommand(),
+		applyCommand(),
+		syncCommand(),
+		fsCommand(),
+		factsCommand(),
+		watchCommand(),
+		exporterCommand(),
+		hostsCommand(),
+		serveCommand(),
+		configCommand(),
+		auditCommand(),
+	}
+
+	withConfig(app.Commands, "")
+
+	// Long-running commands (watch, serve, read --follow) end with Ctrl-C; clean up then too.
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			writeHar()
+			closeTunnels()
+		})
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cleanup()
+		os.Exit(130)
+	}()
 
 	app.Run(os.Args)
+	cleanup()
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Round tripper answering requests like holly does, from the request and its body.
+type fakeHolly func(r *http.Request, body string) (int, string)
+
+func (f fakeHolly) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := ""
+	if r.Body != nil {
+		b, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		body = string(b)
+	}
+
+	code, out := f(r, body)
+	return &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(out)),
+		Request:    r,
+	}, nil
+}
+
+// Send all requests of the test to 'f' instead of the network.
+func withFakeHolly(t *testing.T, f fakeHolly) {
+	old := httpClient
+	httpClient = &http.Client{Transport: f}
+	t.Cleanup(func() { httpClient = old })
+}
+
+// Records the commands sent to the exec endpoint, per host.
+type execLog struct {
+	sync.Mutex
+	cmds map[string][]string
+}
+
+func (l *execLog) add(host, cmd string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.cmds == nil {
+		l.cmds = map[string][]string{}
+	}
+
+	l.cmds[host] = append(l.cmds[host], cmd)
+}
+
+func TestExecDryRunSkipsOut(t *testing.T) {
+	settings.dryRun = true
+	defer func() { settings.dryRun = false }()
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		return http.StatusOK, ""
+	})
+
+	out := filepath.Join(t.TempDir(), "out.txt")
+	if err := httpSendExecCmd("h1", "dir", out, false, true, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("expected no out file under --dry-run, got %v", err)
+	}
+}
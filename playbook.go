@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// Playbook file layout. Steps are applied in order to every target host. With
+// 'gather_facts', host facts are available to templates as '.facts'.
+type playbook struct {
+	Hosts       []string          `yaml:"hosts"`
+	GatherFacts bool              `yaml:"gather_facts"`
+	Vars        map[string]string `yaml:"vars"`
+	Steps       []playStep        `yaml:"steps"`
+}
+
+// A single playbook step. String parameters are expanded as text/template using the
+// playbook vars, registered outputs, 'host' and 'facts' before the action runs.
+type playStep struct {
+	Name         string        `yaml:"name"`
+	Action       string        `yaml:"action"`
+	Hosts        []string      `yaml:"hosts"`
+	When         string        `yaml:"when"`
+	Register     string        `yaml:"register"`
+	Retries      int           `yaml:"retries"`
+	Delay        time.Duration `yaml:"delay"`
+	IgnoreErrors bool          `yaml:"ignore_errors"`
+	OnFailure    []playStep    `yaml:"on_failure"`
+
+	// Action parameters.
+	File    string        `yaml:"file"`
+	Path    string        `yaml:"path"`
+	Cmd     string        `yaml:"cmd"`
+	Args    []string      `yaml:"args"`
+	TmpDir  string        `yaml:"tmpdir"`
+	Out     string        `yaml:"out"`
+	Reboot  *bool         `yaml:"reboot"`
+	Version string        `yaml:"version"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Per-host outcome of a playbook run.
+type playResult struct {
+	host    string
+	ok      int
+	skipped int
+	failed  int
+	err     error
+}
+
+var playFuncs = template.FuncMap{
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"lower":     strings.ToLower,
+	"trim":      strings.TrimSpace,
+}
+
+func loadPlaybook(file string) (*playbook, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	var pb playbook
+	err = yaml.UnmarshalStrict(b, &pb)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	for i := range pb.Steps {
+		if err := pb.Steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("Step %d: %v", i+1, err)
+		}
+	}
+
+	return &pb, nil
+}
+
+func (s *playStep) validate() error {
+	switch s.Action {
+	case "upload", "exec", "run", "update-self", "update-conf", "update-runner", "read", "stat", "wait-for-version":
+	case "":
+		return fmt.Errorf("No action provided.")
+	default:
+		return fmt.Errorf("Unknown action '%s'.", s.Action)
+	}
+
+	for i := range s.OnFailure {
+		if err := s.OnFailure[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *playStep) label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	return s.Action
+}
+
+// Returns true if 'host' is a target of this step.
+func (s *playStep) targets(host string) bool {
+	if len(s.Hosts) == 0 {
+		return true
+	}
+
+	for _, h := range s.Hosts {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expand 'text' as a template against 'vars'.
+func expand(text string, vars map[string]interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	t, err := template.New("").Funcs(playFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, vars)
+	return b.String(), err
+}
+
+// Returns a copy of the step with all string parameters expanded.
+func (s playStep) expand(vars map[string]interface{}) (playStep, error) {
+	var err error
+	fields := []*string{&s.File, &s.Path, &s.Cmd, &s.TmpDir, &s.Out, &s.Version}
+	for _, f := range fields {
+		if *f, err = expand(*f, vars); err != nil {
+			return s, err
+		}
+	}
+
+	args := make([]string, len(s.Args))
+	for i, a := range s.Args {
+		if args[i], err = expand(a, vars); err != nil {
+			return s, err
+		}
+	}
+
+	s.Args = args
+	return s, nil
+}
+
+// Evaluate the step's 'when' condition. Empty conditions are always true.
+func (s *playStep) shouldRun(vars map[string]interface{}) (bool, error) {
+	if s.When == "" {
+		return true, nil
+	}
+
+	v, err := expand(s.When, vars)
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "false", "0", "no":
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Poll the version endpoint until it reports 'version' (compared as a version, so "1.1"
+// doesn't match "1.10") or 'timeout' expires.
+func waitForVersion(host, version string, timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+
+	end := time.Now().Add(timeout)
+	for {
+		body, _, err := httpGetVersion(host)
+		if err == nil && compareVersions(strings.TrimSpace(string(body)), version) == 0 {
+			return body, nil
+		}
+
+		if time.Now().After(end) {
+			return body, fmt.Errorf("Timeout waiting for version '%s' in %s.", version, host)
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+type playRunner struct {
+	pb    *playbook
+	facts map[string]hostFacts
+
+	// With more than one target host, read steps write '<out>.<host>'.
+	multi bool
+
+	// The default runner binary is downloaded once and shared by all hosts.
+	runnerOnce sync.Once
+	runnerFile string
+	runnerErr  error
+}
+
+func (p *playRunner) defaultRunner() (string, error) {
+	p.runnerOnce.Do(func() {
+		infoln("Download latest runner to tempdir:", os.TempDir())
+		f, err := downloadRunner(os.TempDir(), "")
+		p.runnerFile, p.runnerErr = os.TempDir()+`\`+f, err
+	})
+
+	return p.runnerFile, p.runnerErr
+}
+
+// Returns true if the playbook has steps (or failure handlers) whose operation is
+// protected, e.g. exec.
+func (pb *playbook) protected() bool {
+	var walk func(steps []playStep) bool
+	walk = func(steps []playStep) bool {
+		for _, s := range steps {
+			op := strings.Replace(s.Action, "-", " ", 1)
+			if protectedOps[op] || walk(s.OnFailure) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return walk(pb.Steps)
+}
+
+// Run a single (already expanded) step against 'host'. Returns the step output.
+func (p *playRunner) do(host string, s playStep) (string, error) {
+	switch s.Action {
+	case "upload":
+		err := uploadFileGeneric(host, s.File, s.Path)
+		return "", err
+	case "exec":
+		body, status, err := httpExecChange("exec", host, s.Cmd, false, true, 0)
+		if err == nil {
+			err = statusError("Exec", status, nil)
+		}
+
+		return string(body), err
+	case "run":
+		var b bytes.Buffer
+		err := runScript(host, s.File, s.Args, s.TmpDir, &b)
+		return b.String(), err
+	case "update-self":
+		reboot := true
+		if s.Reboot != nil {
+			reboot = *s.Reboot
+		}
+
+		return "", httpSendUpdateService(host, s.File, reboot)
+	case "update-conf":
+		return "", httpSendUpdateConf(host, s.File)
+	case "update-runner":
+		file := s.File
+		if file == "" {
+			f, err := p.defaultRunner()
+			if err != nil {
+				return "", err
+			}
+
+			file = f
+		}
+
+		return "", updateRunner(host, file, false, 0, 0)
+	case "read":
+		body, status, err := httpOctetStream("GET", `http://`+host+`:8080/api/v1/readfile`, s.File)
+		if err == nil {
+			err = statusError("Read", status, body)
+		}
+
+		if err == nil && s.Out != "" {
+			out := s.Out
+			if p.multi {
+				out = out + "." + host
+			}
+
+			err = ioutil.WriteFile(out, body, 0644)
+		}
+
+		return string(body), err
+	case "stat":
+		body, status, err := httpOctetStream("GET", `http://`+host+`:8080/api/v1/filestat`, s.File)
+		if err == nil {
+			err = statusError("Stat", status, body)
+		}
+
+		return string(body), err
+	case "wait-for-version":
+		if dryRunOp(host, "wait-for-version", s.Version) {
+			return "", nil
+		}
+
+		body, err := waitForVersion(host, s.Version, s.Timeout)
+		return string(body), err
+	}
+
+	return "", fmt.Errorf("Unknown action '%s'.", s.Action)
+}
+
+// Run a step with its retries. Returns the step output.
+func (p *playRunner) try(host string, s playStep, vars map[string]interface{}) (string, error) {
+	es, err := s.expand(vars)
+	if err != nil {
+		return "", err
+	}
+
+	var out string
+	for i := 0; i <= s.Retries; i++ {
+		if i > 0 {
+			withHost(host).with("step", s.label()).warnln("retry", i, "of", s.Retries)
+			time.Sleep(s.Delay)
+		}
+
+		out, err = p.do(host, es)
+		if err == nil {
+			break
+		}
+	}
+
+	return out, err
+}
+
+// Apply all steps to 'host' in order. Stops at the first failed step unless the step
+// sets 'ignore_errors'.
+func (p *playRunner) apply(host string) *playResult {
+	res := &playResult{host: host}
+	vars := map[string]interface{}{}
+	for k, v := range p.pb.Vars {
+		vars[k] = v
+	}
+
+	vars["host"] = host
+	if p.facts != nil {
+		vars["facts"] = p.facts[host]
+	}
+
+	for _, s := range p.pb.Steps {
+		if !s.targets(host) {
+			continue
+		}
+
+		run, err := s.shouldRun(vars)
+		if err != nil {
+			withHost(host).with("step", s.label()).errorln("invalid condition:", err)
+			res.failed++
+			res.err = err
+			return res
+		}
+
+		if !run {
+			withHost(host).with("step", s.label()).infoln("skipped")
+			res.skipped++
+			continue
+		}
+
+		out, err := p.try(host, s, vars)
+		if s.Register != "" {
+			vars[s.Register] = strings.TrimSpace(out)
+		}
+
+		if err == nil {
+			withHost(host).with("step", s.label()).infoln("ok")
+			res.ok++
+			continue
+		}
+
+		withHost(host).with("step", s.label()).errorln("failed:", err)
+		res.failed++
+		for _, h := range s.OnFailure {
+			if _, err := p.try(host, h, vars); err != nil {
+				withHost(host).with("step", h.label()).errorln("on_failure handler failed:", err)
+				continue
+			}
+
+			withHost(host).with("step", h.label()).infoln("on_failure handler ok")
+		}
+
+		if !s.IgnoreErrors {
+			res.err = err
+			return res
+		}
+	}
+
+	return res
+}
+
+func printPlaySummary(results []*playResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tOK\tSKIPPED\tFAILED\tSTATUS")
+	for _, r := range results {
+		status := "ok"
+		if r.err != nil {
+			status = r.err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", r.host, r.ok, r.skipped, r.failed, status)
+	}
+
+	w.Flush()
+}
+
+func applyCommand() cli.Command {
+	return cli.Command{
+		Name:      "apply",
+		Usage:     "apply a playbook of ordered steps to host(s)",
+		Flags:     hostsFlags(),
+		ArgsUsage: "<playbook.yaml>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				errorln("No playbook provided.")
+				return fmt.Errorf("No playbook provided.")
+			}
+
+			pb, err := loadPlaybook(c.Args().Get(0))
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			// Host selection flags override the playbook hosts.
+			var hosts []string
+			if c.IsSet("hosts") || c.IsSet("group") || c.IsSet("gitlab-runners") {
+				hosts, err = resolveHosts(c)
+			} else if len(pb.Hosts) > 0 {
+				hosts, err = selectHosts(inventoryFile(c), pb.Hosts, nil, c.String("where"))
+			}
+
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			if len(hosts) == 0 {
+				err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
+				errorln(err)
+				return err
+			}
+
+			if err := checkTargets("apply", pb.protected(), hosts, settings.inventory, cliAnswers()); err != nil {
+				errorln(err)
+				return err
+			}
+
+			p := &playRunner{pb: pb, multi: len(hosts) > 1}
+			if pb.GatherFacts {
+				p.facts = hostsFacts(hosts, defaultFactsTTL)
+			}
+
+			results := make([]*playResult, len(hosts))
+			var wg sync.WaitGroup
+			for i, host := range hosts {
+				wg.Add(1)
+				go func(i int, host string) {
+					defer wg.Done()
+					infoln("Start playbook for " + host + ".")
+					results[i] = p.apply(host)
+				}(i, host)
+			}
+
+			wg.Wait()
+			printPlaySummary(results)
+			failed := 0
+			for _, r := range results {
+				if r.err != nil {
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("Playbook failed on %d of %d host(s).", failed, len(hosts))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaybookFailedStatus(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "conf.yaml")
+	if err := ioutil.WriteFile(file, []byte("a: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := 0
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		if strings.Contains(body, "handler") {
+			handled++
+			return 200, ""
+		}
+
+		return 404, "not found"
+	})
+
+	steps := []playStep{
+		{Action: "upload", File: file, Path: `c:\temp`},
+		{Action: "update-self", File: file},
+		{Action: "update-conf", File: file},
+		{Action: "read", File: `c:\temp\x`},
+		{Action: "stat", File: `c:\temp\x`},
+		{Action: "exec", Cmd: "hostname"},
+	}
+
+	for _, s := range steps {
+		s.OnFailure = []playStep{{Action: "exec", Cmd: "echo handler"}}
+		p := &playRunner{pb: &playbook{Steps: []playStep{s}}}
+		res := p.apply("h1")
+		if res.err == nil || res.failed != 1 {
+			t.Errorf("%s: expected the step to fail on 404, got %+v", s.Action, res)
+		}
+	}
+
+	if handled != len(steps) {
+		t.Errorf("on_failure ran %d times, want %d", handled, len(steps))
+	}
+}
+
+func TestWaitForVersionExact(t *testing.T) {
+	var version string
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) { return 200, version + "\n" })
+	for _, tt := range []struct {
+		reply string
+		ok    bool
+	}{
+		{"11.1", false},
+		{"1.10", false},
+		{"1.1.1", false},
+		{"1.1", true},
+	} {
+		version = tt.reply
+		_, err := waitForVersion("h1", "1.1", time.Nanosecond)
+		if (err == nil) != tt.ok {
+			t.Errorf("reply %q: got %v, want accepted %v", tt.reply, err, tt.ok)
+		}
+	}
+}
+
+func TestPlaybookReadPerHost(t *testing.T) {
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) { return 200, "from " + r.URL.Hostname() })
+	out := filepath.Join(t.TempDir(), "log.txt")
+	p := &playRunner{pb: &playbook{Steps: []playStep{{Action: "read", File: "/var/log/x", Out: out}}}, multi: true}
+	for _, host := range []string{"h1", "h2"} {
+		if res := p.apply(host); res.err != nil {
+			t.Fatal(res.err)
+		}
+	}
+
+	for _, host := range []string{"h1", "h2"} {
+		b, err := ioutil.ReadFile(out + "." + host)
+		if err != nil || string(b) != "from "+host {
+			t.Errorf("%s: got %q, %v", host, b, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Proxy schemes accepted in --proxy and the inventory. 'ssh' tunnels to the holly port
+// through a bastion host using the local ssh client.
+var proxySchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"socks5": true,
+	"ssh":    true,
+}
+
+// Inventory used for per-host and per-group proxies, loaded on first use.
+var proxyInventory struct {
+	sync.Once
+	inv *inventory
+	err error
+}
+
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || !proxySchemes[u.Scheme] || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy '%s', expecting http://, https://, socks5:// or ssh:// url.", s)
+	}
+
+	return u, nil
+}
+
+// Returns the proxy set for 'host' in the inventory: its own entry in 'proxies' first,
+// then the first group (by name) that lists the host and has a proxy.
+func (inv *inventory) hostProxy(host string) string {
+	if p, ok := inv.Proxies[host]; ok {
+		return p
+	}
+
+	names := []string{}
+	for n := range inv.Groups {
+		names = append(names, n)
+	}
+
+	sort.Strings(names)
+	for _, n := range names {
+		g := inv.Groups[n]
+		if g.Proxy == "" {
+			continue
+		}
+
+		for _, h := range g.Hosts {
+			if h == host {
+				return g.Proxy
+			}
+		}
+	}
+
+	return ""
+}
+
+// Returns the configured proxy of 'host' from the inventory or --proxy, nil if none. A broken
+// inventory fails every request rather than silently skipping its proxies.
+func proxyFor(host string) (*url.URL, error) {
+	proxyInventory.Do(func() {
+		proxyInventory.inv, proxyInventory.err = loadInventory(settings.inventory)
+	})
+
+	if proxyInventory.err != nil {
+		return nil, fmt.Errorf("Cannot resolve proxy of %s: %v", host, proxyInventory.err)
+	}
+
+	p := settings.proxy
+	if hp := proxyInventory.inv.hostProxy(host); hp != "" {
+		p = hp
+	}
+
+	if p == "" {
+		return nil, nil
+	}
+
+	return parseProxy(p)
+}
+
+// Proxy function of the shared transport. Falls back to the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables. SSH proxies are handled when dialing instead.
+func proxyFunc(r *http.Request) (*url.URL, error) {
+	u, err := proxyFor(r.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	if u == nil {
+		return http.ProxyFromEnvironment(r)
+	}
+
+	if u.Scheme == "ssh" {
+		return nil, nil
+	}
+
+	return u, nil
+}
+
+// Returns a dial function that connects through an ssh tunnel when the target host uses
+// an ssh proxy, and directly otherwise.
+func dialFunc(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		u, err := proxyFor(host)
+		if err != nil {
+			return nil, err
+		}
+
+		if u != nil && u.Scheme == "ssh" {
+			local, err := openTunnel(u, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			addr = local
+		}
+
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+type sshTunnel struct {
+	cmd   *exec.Cmd
+	local string
+}
+
+// Open tunnels, keyed by bastion and target address.
+var tunnels = struct {
+	sync.Mutex
+	m map[string]*sshTunnel
+}{m: map[string]*sshTunnel{}}
+
+// Returns a free local tcp port.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Start (or reuse) 'ssh -N -L' forwarding a local port to 'addr' through 'bastion' and
+// return the local address. Authentication must work non-interactively (keys or agent).
+func openTunnel(bastion *url.URL, addr string) (string, error) {
+	key := bastion.Host + "|" + addr
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	if t, ok := tunnels.m[key]; ok {
+		return t.local, nil
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return "", err
+	}
+
+	local := "127.0.0.1:" + strconv.Itoa(port)
+	args := []string{"-N", "-o", "ExitOnForwardFailure=yes", "-o", "BatchMode=yes", "-L", local + ":" + addr}
+	if p := bastion.Port(); p != "" {
+		args = append(args, "-p", p)
+	}
+
+	target := bastion.Hostname()
+	if bastion.User != nil {
+		target = bastion.User.Username() + "@" + target
+	}
+
+	cmd := exec.Command("ssh", append(args, target)...)
+	if err := cmd.Start(); err != nil {
+		errorln(err)
+		return "", err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Wait until the forwarded port accepts connections.
+	deadline := time.Now().Add(settings.connectTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return "", fmt.Errorf("SSH tunnel to %s through %s failed: %v", addr, bastion.Host, err)
+		default:
+		}
+
+		if conn, err := net.DialTimeout("tcp", local, time.Second); err == nil {
+			conn.Close()
+			break
+		}
+
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			return "", fmt.Errorf("SSH tunnel to %s through %s timed out.", addr, bastion.Host)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	debugln("Tunnel", local, "->", addr, "through", bastion.Host)
+	tunnels.m[key] = &sshTunnel{cmd: cmd, local: local}
+	return local, nil
+}
+
+// Stop all ssh tunnels.
+func closeTunnels() {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	for key, t := range tunnels.m {
+		t.cmd.Process.Kill()
+		delete(tunnels.m, key)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returns the local file for the slash-separated 'rel' under '<outdir>/<host>'. Paths that
+// escape the host directory are rejected.
+func localHostPath(outdir, host, rel string) (string, error) {
+	base := filepath.Join(outdir, host)
+	p := filepath.Join(base, filepath.FromSlash(rel))
+	if p != base && !strings.HasPrefix(p, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid path '%s'.", rel)
+	}
+
+	return p, nil
+}
+
+// Split a remote glob pattern into the directory to list and the slash-separated
+// pattern relative to it.
+func splitRemoteGlob(shell, pattern string) (string, string) {
+	i := strings.IndexAny(pattern, "*?[")
+	if i < 0 {
+		return pattern, ""
+	}
+
+	j := strings.LastIndexAny(pattern[:i], `\/`)
+	if j < 0 {
+		return "", pattern
+	}
+
+	rel := pattern[j+1:]
+	if shell == "cmd" {
+		rel = strings.Replace(rel, `\`, "/", -1)
+	}
+
+	return pattern[:j], rel
+}
+
+// Download the files under the remote 'dir' matching 'pattern' (all files when empty)
+// into '<outdir>/<host>/...'.
+func readTree(host, dir, pattern, outdir string) error {
+	shell := remoteShell(dir)
+	files, err := remoteTree(host, shell, dir)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	failed := 0
+	for _, rel := range files {
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, rel); !ok {
+				continue
+			}
+		}
+
+		local, err := localHostPath(outdir, host, rel)
+		if err != nil {
+			errorln(err)
+			failed++
+			continue
+		}
+
+		remote := remotePath(shell, dir, rel)
+		err = readToFile(host, remote, local)
+		if err != nil {
+			withHost(host).errorln(remote, "failed:", err)
+			failed++
+			continue
+		}
+
+		withHost(host).infoln(remote, "->", local)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed in %s.", failed, host)
+	}
+
+	return nil
+}
+
+// Ask holly for an archive ("zip" or "tar.gz") of the remote 'dir' and extract it
+// into '<outdir>/<host>/...'.
+func readArchive(host, dir, format, outdir string) error {
+	if format != "zip" && format != "tar.gz" {
+		err := fmt.Errorf("Unsupported archive format '%s'.", format)
+		errorln(err)
+		return err
+	}
+
+	url := `http://` + host + `:8080/api/v1/readfile?archive=` + format
+	body, status, err := httpOctetStream("GET", url, dir)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	if !strings.HasPrefix(status, "200") {
+		return fmt.Errorf("Archive of %s failed with status: %s", dir, status)
+	}
+
+	withHost(host).infoln(fmt.Sprintf("%s archive: %d bytes", format, len(body)))
+	if format == "zip" {
+		return extractZip(body, outdir, host)
+	}
+
+	return extractTarGz(body, outdir, host)
+}
+
+// Stream the remote 'file' into the local file 'local', creating its directory.
+func readToFile(host, file, local string) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	_, err = httpReadRange(host, file, 0, 0, f)
+	return err
+}
+
+func writeLocal(local string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func extractZip(data []byte, outdir, host string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+
+		local, err := localHostPath(outdir, host, strings.Replace(zf.Name, `\`, "/", -1))
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		err = writeLocal(local, rc)
+		rc.Close()
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		withHost(host).infoln(zf.Name, "->", local)
+	}
+
+	return nil
+}
+
+func extractTarGz(data []byte, outdir, host string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		local, err := localHostPath(outdir, host, hdr.Name)
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		if err := writeLocal(local, tr); err != nil {
+			errorln(err)
+			return err
+		}
+
+		withHost(host).infoln(hdr.Name, "->", local)
+	}
+}
+
+type readOptions struct {
+	offset   int64
+	length   int64
+	tail     int
+	follow   bool
+	interval time.Duration
+}
+
+// Returns the writer for a single host's output: 'out' (suffixed with the host when 'multi'
+// is set), or stdout. Call the returned function when done writing.
+func readOutput(out, host string, multi bool) (io.Writer, func(), error) {
+	if out == "" {
+		if !multi {
+			return os.Stdout, func() {}, nil
+		}
+
+		hw := newHostWriter(os.Stdout, host)
+		return hw, func() { hw.Flush() }, nil
+	}
+
+	if multi {
+		out = out + "." + host
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, func() { f.Close() }, nil
+}
+
+// Stream the remote 'file' to 'w', honoring the range, tail and follow options.
+func readStream(host, file string, o *readOptions, w io.Writer) error {
+	if o.tail > 0 {
+		pos, err := tailFile(host, file, o.tail, w)
+		if err != nil || !o.follow {
+			return err
+		}
+
+		return followFile(host, file, pos, o.interval, w)
+	}
+
+	n, err := httpReadRange(host, file, o.offset, o.length, w)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	withHost(host).infoln(fmt.Sprintf("%d bytes read.", n))
+	return nil
+}
+
+// Copy 'length' bytes (to the end when 0) of the remote 'file' starting at 'offset' to 'w'.
+// A negative 'offset' reads the last -offset bytes. A Range header is sent to holly; if the
+// full file comes back instead, the range is applied locally. Returns the bytes written.
+func httpReadRange(host, file string, offset, length int64, w io.Writer) (int64, error) {
+	url := `http://` + host + `:8080/api/v1/readfile`
+	resp, err := doRequest(func() (*http.Request, error) {
+		r, err := newRequest("GET", url, "application/octet-stream", []byte(file))()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case offset < 0:
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d", offset))
+		case length > 0:
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		case offset > 0:
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		return r, nil
+	})
+	if err != nil {
+		errorln(err)
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return io.Copy(w, resp.Body)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, nil
+	case http.StatusOK:
+	default:
+		return 0, fmt.Errorf("Read failed with status: %s", resp.Status)
+	}
+
+	if offset < 0 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+
+		if int64(len(body)) > -offset {
+			body = body[int64(len(body))+offset:]
+		}
+
+		n, err := w.Write(body)
+		return int64(n), err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	if length > 0 {
+		n, err := io.CopyN(w, resp.Body, length)
+		if err == io.EOF {
+			err = nil
+		}
+
+		return n, err
+	}
+
+	return io.Copy(w, resp.Body)
+}
+
+// Returns the size of the remote 'file'.
+func remoteSize(host, file string) (int64, error) {
+	stats, err := httpFileStats(host, []string{file})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(stats) == 0 || !stats[0].Exists {
+		return 0, fmt.Errorf("File %s not found in %s.", file, host)
+	}
+
+	return stats[0].Size, nil
+}
+
+// Write the last 'n' lines of the remote 'file' to 'w'. Returns the file size at the time
+// of reading, which is where a follow should continue from.
+func tailFile(host, file string, n int, w io.Writer) (int64, error) {
+	size, err := remoteSize(host, file)
+	if err != nil {
+		errorln(err)
+		return 0, err
+	}
+
+	// A zero length range reads the whole file.
+	if size == 0 {
+		return 0, nil
+	}
+
+	chunk := int64(n+1) * 128
+	for {
+		off := size - chunk
+		if off < 0 {
+			off = 0
+		}
+
+		var b bytes.Buffer
+		if _, err := httpReadRange(host, file, off, size-off, &b); err != nil {
+			errorln(err)
+			return 0, err
+		}
+
+		data := b.Bytes()
+		if bytes.Count(bytes.TrimRight(data, "\n"), []byte("\n")) >= n || off == 0 {
+			lines := bytes.SplitAfter(data, []byte("\n"))
+			if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+				lines = lines[:len(lines)-1]
+			}
+
+			if len(lines) > n {
+				lines = lines[len(lines)-n:]
+			}
+
+			_, err := w.Write(bytes.Join(lines, nil))
+			return size, err
+		}
+
+		chunk *= 4
+	}
+}
+
+// Poll the remote 'file' every 'interval' and write anything appended after 'pos' to 'w'.
+// Starts over from the beginning when the file is smaller than 'pos' (a file replaced by
+// a bigger one is not noticed). Returns on the first error, e.g. when the file is gone.
+func followFile(host, file string, pos int64, interval time.Duration, w io.Writer) error {
+	for {
+		time.Sleep(interval)
+		size, err := remoteSize(host, file)
+		if err != nil {
+			withHost(host).errorln(err)
+			return err
+		}
+
+		if size < pos {
+			withHost(host).warnln(file, "truncated, reading from start.")
+			pos = 0
+		}
+
+		if size == pos {
+			continue
+		}
+
+		n, err := httpReadRange(host, file, pos, size-pos, w)
+		if err != nil {
+			withHost(host).errorln(err)
+			return err
+		}
+
+		pos += n
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake holly serving a single file whose content the test can change.
+type fakeFile struct {
+	exists bool
+	data   string
+	reads  int
+}
+
+func (f *fakeFile) serve(r *http.Request, body string) (int, string) {
+	if strings.HasSuffix(r.URL.Path, "/filestat") {
+		return 200, fmt.Sprintf(`[{"path": %q, "exists": %v, "size": %d}]`, body, f.exists, len(f.data))
+	}
+
+	f.reads++
+	return 200, f.data
+}
+
+func TestTailEmptyFile(t *testing.T) {
+	f := &fakeFile{exists: true}
+	withFakeHolly(t, f.serve)
+	var b bytes.Buffer
+	pos, err := tailFile("h1", "/var/log/x", 10, &b)
+	if err != nil || pos != 0 || b.Len() != 0 || f.reads != 0 {
+		t.Errorf("got pos %d, %q, %v after %d read(s), want an empty tail without reads", pos, b.String(), err, f.reads)
+	}
+}
+
+func TestFollowFileGone(t *testing.T) {
+	f := &fakeFile{data: "a\n"}
+	withFakeHolly(t, f.serve)
+	done := make(chan error, 1)
+	var b bytes.Buffer
+	go func() { done <- followFile("h1", "/var/log/x", 2, time.Millisecond, &b) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("expected a not found error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("followFile kept polling a missing file")
+	}
+}
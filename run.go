@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Interpreter information for scripts we can run remotely.
+type interpreter struct {
+	// Command prefix, script path and args are appended after this.
+	prefix string
+	// Shell used to quote the script path and arguments ("cmd" or "sh").
+	shell string
+	// Default remote temp directory when --tmpdir is not set.
+	tmpdir string
+}
+
+var interpreters = map[string]interpreter{
+	".ps1": {`powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File`, "cmd", `c:\windows\temp`},
+	".bat": {`cmd /c`, "cmd", `c:\windows\temp`},
+	".cmd": {`cmd /c`, "cmd", `c:\windows\temp`},
+	".sh":  {`sh`, "sh", `/tmp`},
+	".py":  {`python`, "cmd", `c:\windows\temp`},
+}
+
+// Quote a single command line argument for the target shell.
+func quoteArg(shell, arg string) string {
+	if shell == "sh" {
+		return `'` + strings.Replace(arg, `'`, `'\''`, -1) + `'`
+	}
+
+	if arg != "" && !strings.ContainsAny(arg, " \t\"&|<>^()") {
+		return arg
+	}
+
+	return `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+}
+
+// Join a remote directory and a file name using the target shell's separator.
+func remoteJoin(shell, dir, name string) string {
+	sep := `\`
+	if shell == "sh" {
+		sep = `/`
+	}
+
+	return strings.TrimRight(dir, `\/`) + sep + name
+}
+
+// Writer that prefixes every line written to it with the host name. Complete lines are
+// written at once so output from concurrent hosts doesn't interleave.
+type hostWriter struct {
+	w    io.Writer
+	host string
+	buf  []byte
+}
+
+var hostWriterMu sync.Mutex
+
+func newHostWriter(w io.Writer, host string) *hostWriter {
+	return &hostWriter{w: w, host: host}
+}
+
+func (h *hostWriter) Write(p []byte) (int, error) {
+	h.buf = append(h.buf, p...)
+	for {
+		i := bytes.IndexByte(h.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		if err := h.writeLine(h.buf[:i+1]); err != nil {
+			return 0, err
+		}
+
+		h.buf = h.buf[i+1:]
+	}
+}
+
+func (h *hostWriter) writeLine(line []byte) error {
+	hostWriterMu.Lock()
+	defer hostWriterMu.Unlock()
+	_, err := h.w.Write(append([]byte("["+h.host+"] "), line...))
+	return err
+}
+
+// Write any pending partial line.
+func (h *hostWriter) Flush() error {
+	if len(h.buf) == 0 {
+		return nil
+	}
+
+	line := append(h.buf, '\n')
+	h.buf = nil
+	return h.writeLine(line)
+}
+
+// Returns the shell ("cmd" or "sh") of a remote host based on the style of 'path'.
+func remoteShell(path string) string {
+	if strings.HasPrefix(path, "/") {
+		return "sh"
+	}
+
+	return "cmd"
+}
+
+// Returns the command line that removes 'path' using the target shell.
+func remoteRemoveCmd(shell, path string) string {
+	if shell == "sh" {
+		return `rm -f ` + quoteArg("sh", path)
+	}
+
+	return `cmd /c del /f /q ` + quoteArg("cmd", path)
+}
+
+// Upload a local script to 'host', run it with the interpreter matching its extension,
+// then remove the remote copy regardless of the outcome. Script output is copied to 'w'.
+func runScript(host, script string, args []string, tmpdir string, w io.Writer) error {
+	if host == "" {
+		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
+		errorln(err)
+		return err
+	}
+
+	ext := strings.ToLower(filepath.Ext(script))
+	in, ok := interpreters[ext]
+	if !ok {
+		err := fmt.Errorf("Unsupported script type '%s'.", ext)
+		errorln(err)
+		return err
+	}
+
+	dir := tmpdir
+	if dir == "" {
+		dir = in.tmpdir
+	}
+
+	// Use a unique name so concurrent runs of the same script don't collide.
+	name := fmt.Sprintf("n1-run-%d-%s", time.Now().UnixNano(), filepath.Base(script))
+	remote := remoteJoin(in.shell, dir, name)
+	line := in.prefix + " " + quoteArg(in.shell, remote)
+	for _, arg := range args {
+		line = line + " " + quoteArg(in.shell, arg)
+	}
+
+	withHost(host).infoln("Start uploading " + script + " to " + remote + ".")
+	body, status, err := uploadFileAs(host, script, name, dir)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	withHost(host).debugln(status, strings.TrimSpace(string(body)))
+	if !strings.HasPrefix(status, "200") {
+		err := fmt.Errorf("Upload of %s failed with status: %s %s", script, status, strings.TrimSpace(string(body)))
+		errorln(err)
+		return err
+	}
+
+	if dryRunRequest("GET", execUrl(host, false, true, 0), nil, line) {
+		return nil
+	}
+
+	defer func() {
+		rm := remoteRemoveCmd(in.shell, remote)
+		if _, err := httpExecStream(host, rm, ioutil.Discard); err != nil {
+			withHost(host).warnln("Failed to remove", remote+":", err)
+		}
+	}()
+
+	withHost(host).infoln(line)
+	status, err = httpExecStream(host, line, w)
+	auditExec("run", host, line, status, err)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	return nil
+}
+
+func runCommand() cli.Command {
+	return cli.Command{
+		Name:  "run",
+		Usage: "upload and run a local script (.ps1, .bat, .cmd, .sh, .py)",
+		Flags: append(hostsFlags(),
+			cli.StringFlag{
+				Name:  "tmpdir",
+				Value: "",
+				Usage: "remote temp `dir` (default: c:\\windows\\temp, /tmp for .sh)",
+			},
+		),
+		ArgsUsage: "<script> [args...]",
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				errorln("No script provided.")
+				return fmt.Errorf("No script provided.")
+			}
+
+			script := c.Args().Get(0)
+			args := c.Args().Tail()
+			failed := []string{}
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			if err := confirmTargets("run", hosts); err != nil {
+				errorln(err)
+				return err
+			}
+
+			for _, host := range hosts {
+				infoln("Start run script request for " + host + ".")
+				hw := newHostWriter(os.Stdout, host)
+				err := runScript(host, script, args, c.String("tmpdir"), hw)
+				hw.Flush()
+				if err != nil {
+					failed = append(failed, host)
+				}
+			}
+
+			if len(failed) > 0 {
+				return fmt.Errorf("Script failed on: %s", strings.Join(failed, ","))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuoteArg(t *testing.T) {
+	tests := []struct {
+		shell, arg, want string
+	}{
+		{"sh", "plain", `'plain'`},
+		{"sh", "it's", `'it'\''s'`},
+		{"sh", "", `''`},
+		{"cmd", `c:\runner\x.exe`, `c:\runner\x.exe`},
+		{"cmd", "two words", `"two words"`},
+		{"cmd", `say "hi"`, `"say \"hi\""`},
+		{"cmd", "a&b", `"a&b"`},
+		{"cmd", "", `""`},
+	}
+
+	for _, tt := range tests {
+		if got := quoteArg(tt.shell, tt.arg); got != tt.want {
+			t.Errorf("quoteArg(%q, %q) = %s, want %s", tt.shell, tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteJoin(t *testing.T) {
+	if got := remoteJoin("cmd", `c:\windows\temp\`, "x.ps1"); got != `c:\windows\temp\x.ps1` {
+		t.Errorf("got %s", got)
+	}
+
+	if got := remoteJoin("sh", "/tmp/", "x.sh"); got != "/tmp/x.sh" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestRunScriptFailedUpload(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "x.sh")
+	if err := ioutil.WriteFile(script, []byte("echo hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log := &execLog{}
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		if strings.HasSuffix(r.URL.Path, "/exec") {
+			log.add(r.URL.Hostname(), body)
+			return 200, ""
+		}
+
+		return 500, "disk full"
+	})
+
+	if err := runScript("h1", script, nil, "", os.Stdout); err == nil {
+		t.Error("expected an error when the upload fails")
+	}
+
+	if len(log.cmds["h1"]) > 0 {
+		t.Errorf("nothing should run after a failed upload, got %q", log.cmds["h1"])
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+)
+
+// Default runner binary in non-windows hosts, found in the PATH.
+const runnerPathSh = "gitlab-runner"
+
+// State of a runner registration as reported by the runner's output.
+type runnerState struct {
+	Runner string `json:"runner"`
+	State  string `json:"state"`
+}
+
+// Result of a runner lifecycle command in a single host.
+type runnerResult struct {
+	Host    string        `json:"host"`
+	Action  string        `json:"action"`
+	Ok      bool          `json:"ok"`
+	Service string        `json:"service,omitempty"`
+	Runners []runnerState `json:"runners,omitempty"`
+	Output  string        `json:"output,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// A runner command: its arguments in 'host', whether it changes the host, and values to
+// redact from the audit log and dry-run output.
+type runnerAction struct {
+	name   string
+	change bool
+	args   func(c *cli.Context, host, shell, config string) []string
+	secret func(c *cli.Context) string
+
+	// Validates the flags before any host is contacted, optional.
+	check func(c *cli.Context) error
+}
+
+var (
+	reRunnerService = regexp.MustCompile(`Service (?:is |has )?(running|stopped|not running|not installed)`)
+	reRunnerVerify  = regexp.MustCompile(`Verifying runner\.\.\. is ([a-z]+(?: [a-z]+)*).*?runner=(\w+)`)
+	reRunnerToken   = regexp.MustCompile(`(?:succeeded|registered successfully).*?runner=(\w+)`)
+	reRunnerError   = regexp.MustCompile(`(?m)^(?:FATAL|ERROR|PANIC): (.*)$`)
+)
+
+// Returns the shell ("cmd" or "sh") and runner binary of 'host', from its facts when
+// known, else from the style of the --runner path.
+func runnerTarget(host, runner string, facts map[string]hostFacts) (string, string) {
+	shell := remoteShell(runner)
+	if f, ok := facts[host]; ok && f["os"] != "" {
+		shell = "sh"
+		if f["os"] == "windows" {
+			shell = "cmd"
+		}
+	}
+
+	if runner == "" {
+		runner = runnerPath
+		if shell == "sh" {
+			runner = runnerPathSh
+		}
+	}
+
+	return shell, runner
+}
+
+// Returns the runner config file passed to the runner: --runner-config, or config.toml
+// next to the binary in windows, where the runner otherwise uses its working directory.
+func runnerConfig(shell, runner, config string) string {
+	if config != "" || shell != "cmd" {
+		return config
+	}
+
+	if i := strings.LastIndexAny(runner, `\/`); i >= 0 {
+		return runner[:i+1] + "config.toml"
+	}
+
+	return ""
+}
+
+// Parse the output of a runner command into 'res'.
+func parseRunnerOutput(out string, res *runnerResult) {
+	res.Output = strings.TrimSpace(out)
+	if m := reRunnerService.FindStringSubmatch(out); m != nil {
+		res.Service = strings.Replace(m[1], "not running", "stopped", 1)
+	}
+
+	for _, m := range reRunnerVerify.FindAllStringSubmatch(out, -1) {
+		res.Runners = append(res.Runners, runnerState{Runner: m[2], State: m[1]})
+	}
+
+	for _, m := range reRunnerToken.FindAllStringSubmatch(out, -1) {
+		res.Runners = append(res.Runners, runnerState{Runner: m[1], State: res.Action + "ed"})
+	}
+
+	// Removed runners are reported by verify as errors, they are in Runners already.
+	for _, m := range reRunnerError.FindAllStringSubmatch(out, -1) {
+		if !strings.HasPrefix(m[1], "Verifying runner") {
+			res.Error = strings.TrimSpace(m[1])
+			break
+		}
+	}
+}
+
+// Run runner command 'line' in 'host'. Changes are skipped by --dry-run and recorded in
+// the audit log as 'shown', the command line with secrets redacted.
+func runnerExec(host, op, line, shown string, change bool) ([]byte, string, error) {
+	if !change {
+		return httpExec(host, line, false, true, 0)
+	}
+
+	if dryRunRequest("GET", execUrl(host, false, true, 0), nil, shown) {
+		return nil, dryRunStatus, nil
+	}
+
+	body, status, err := httpExec(host, line, false, true, 0)
+	auditExec(op, host, shown, status, err)
+	return body, status, err
+}
+
+// Returns true if the action changes the hosts, as 'verify --delete' does.
+func (a runnerAction) isChange(c *cli.Context) bool {
+	return a.change || c.Bool("delete")
+}
+
+// Fill in 'r' from the output and http status of its runner action. Status results without
+// a service state are failures, with the state "unknown".
+func runnerOutcome(r *runnerResult, out, status string) {
+	parseRunnerOutput(out, r)
+	if status == dryRunStatus {
+		r.Ok = true
+		return
+	}
+
+	if !strings.HasPrefix(status, "200") {
+		if r.Error == "" {
+			r.Error = "Runner " + r.Action + " failed with status: " + status
+		}
+
+		return
+	}
+
+	if r.Action == "status" && r.Service == "" {
+		r.Service = "unknown"
+		if r.Error == "" {
+			r.Error = "No service state in the runner output."
+		}
+	}
+
+	r.Ok = r.Error == ""
+	for _, s := range r.Runners {
+		if r.Action == "verify" && s.State != "alive" && s.State != "valid" {
+			r.Ok = false
+		}
+	}
+}
+
+// Run runner action 'a' in all hosts concurrently. Results are in the order of 'hosts'.
+func runRunnerAction(c *cli.Context, a runnerAction, hosts []string) []runnerResult {
+	if a.secret != nil {
+		redactValue(a.secret(c))
+	}
+
+	facts := hostsFacts(hosts, defaultFactsTTL)
+	res := make([]runnerResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			r := &res[i]
+			r.Host, r.Action = host, a.name
+			shell, runner := runnerTarget(host, c.String("runner"), facts)
+			line := quoteArg(shell, runner) + " " + a.name
+			for _, arg := range a.args(c, host, shell, runnerConfig(shell, runner, c.String("runner-config"))) {
+				line = line + " " + quoteArg(shell, arg)
+			}
+
+			shown := line
+			if a.secret != nil && a.secret(c) != "" {
+				shown = strings.Replace(line, a.secret(c), "[redacted]", -1)
+			}
+
+			withHost(host).debugln(shown)
+			body, status, err := runnerExec(host, "runner-"+a.name, line, shown, a.isChange(c))
+			if err != nil {
+				r.Error = err.Error()
+				return
+			}
+
+			runnerOutcome(r, string(body), status)
+		}(i, host)
+	}
+
+	wg.Wait()
+	return res
+}
+
+func printRunnerResults(res []runnerResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tACTION\tOK\tSERVICE\tRUNNERS\tERROR")
+	for _, r := range res {
+		runners := []string{}
+		for _, s := range r.Runners {
+			runners = append(runners, s.Runner+"="+s.State)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\n", r.Host, r.Action, r.Ok, r.Service, strings.Join(runners, ","), r.Error)
+	}
+
+	w.Flush()
+}
+
+// Returns the 'runner <action>' subcommand.
+func runnerActionCommand(a runnerAction, usage string, flags ...cli.Flag) cli.Command {
+	common := append(hostsFlags(),
+		cli.StringFlag{
+			Name:  "runner",
+			Value: "",
+			Usage: "runner binary `path` in the hosts (default: " + runnerPath + " in windows, " + runnerPathSh + " elsewhere)",
+		},
+		cli.StringFlag{
+			Name:  "runner-config",
+			Value: "",
+			Usage: "runner config `file` in the hosts (default: config.toml next to the binary in windows)",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print results as json, with the runner output",
+		},
+	)
+
+	return cli.Command{
+		Name:  a.name,
+		Usage: usage,
+		Flags: append(common, flags...),
+		Action: func(c *cli.Context) error {
+			if a.check != nil {
+				if err := a.check(c); err != nil {
+					errorln(err)
+					return err
+				}
+			}
+
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			if a.isChange(c) {
+				if err := confirmTargets("runner "+a.name, hosts); err != nil {
+					errorln(err)
+					return err
+				}
+			}
+
+			res := runRunnerAction(c, a, hosts)
+			if c.Bool("json") {
+				b, _ := json.MarshalIndent(res, "", "  ")
+				fmt.Println(string(b))
+			} else {
+				printRunnerResults(res)
+			}
+
+			failed := []string{}
+			for _, r := range res {
+				if !r.Ok {
+					failed = append(failed, r.Host)
+				}
+			}
+
+			if len(failed) > 0 {
+				return fmt.Errorf("Runner %s failed on: %s", a.name, strings.Join(failed, ","))
+			}
+
+			return nil
+		},
+	}
+}
+
+// Returns '--config <file>' when 'config' is set.
+func runnerConfigArgs(config string) []string {
+	if config == "" {
+		return nil
+	}
+
+	return []string{"--config", config}
+}
+
+func runnerCommand() cli.Command {
+	downloadFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "dir",
+			Value: "",
+			Usage: "target directory",
+		},
+		cli.StringFlag{
+			Name:  "url",
+			Value: "",
+			Usage: "file url to download (default: 64bit runner)",
+		},
+	}
+
+	download := func(c *cli.Context) error {
+		_, err := downloadRunner(c.String("dir"), c.String("url"))
+		return err
+	}
+
+	register := runnerAction{
+		name:   "register",
+		change: true,
+		args: func(c *cli.Context, host, shell, config string) []string {
+			url := c.String("url")
+			if url == "" {
+				url = gitlab.url
+			}
+
+			// Runner authentication tokens (gitlab 15.10+) replace registration tokens.
+			tokenFlag := "--registration-token"
+			if strings.HasPrefix(c.String("token"), "glrt-") {
+				tokenFlag = "--token"
+			}
+
+			description := c.String("description")
+			if description == "" {
+				description = host
+			}
+
+			args := append(runnerConfigArgs(config), "--non-interactive", "--url", url, tokenFlag, c.String("token"),
+				"--executor", c.String("executor"), "--description", description)
+			if c.String("tags") != "" {
+				args = append(args, "--tag-list", c.String("tags"))
+			}
+
+			if c.Bool("run-untagged") {
+				args = append(args, "--run-untagged")
+			}
+
+			return append(args, c.StringSlice("arg")...)
+		},
+		secret: func(c *cli.Context) string { return c.String("token") },
+	}
+
+	unregister := runnerAction{
+		name:   "unregister",
+		change: true,
+		args: func(c *cli.Context, host, shell, config string) []string {
+			if c.Bool("all") {
+				return append(runnerConfigArgs(config), "--all-runners")
+			}
+
+			return append(runnerConfigArgs(config), "--name", c.String("name"))
+		},
+		check: func(c *cli.Context) error {
+			switch {
+			case c.String("name") == "" && !c.Bool("all"):
+				return fmt.Errorf("No runner selected. See --name or --all flag for more info.")
+			case c.String("name") != "" && c.Bool("all"):
+				return fmt.Errorf("Use either --name or --all, not both.")
+			}
+
+			return nil
+		},
+	}
+
+	verify := runnerAction{
+		name: "verify",
+		args: func(c *cli.Context, host, shell, config string) []string {
+			if c.Bool("delete") {
+				return append(runnerConfigArgs(config), "--delete")
+			}
+
+			return runnerConfigArgs(config)
+		},
+	}
+
+	service := func(c *cli.Context, host, shell, config string) []string {
+		if c.String("service") == "" {
+			return nil
+		}
+
+		return []string{"--service", c.String("service")}
+	}
+
+	serviceFlag := cli.StringFlag{
+		Name:  "service",
+		Value: "",
+		Usage: "runner service `name` (default: the runner's own)",
+	}
+
+	return cli.Command{
+		Name:   "runner",
+		Usage:  "manage gitlab runners: download, register, unregister, verify, restart, status",
+		Flags:  downloadFlags,
+		Action: download,
+		Subcommands: []cli.Command{
+			{
+				Name:   "download",
+				Usage:  "download gitlab runner",
+				Flags:  downloadFlags,
+				Action: download,
+			},
+			runnerActionCommand(register, "register the runner with gitlab",
+				cli.StringFlag{
+					Name:  "url",
+					Value: "",
+					Usage: "gitlab `url` (default: --gitlab-url)",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					Value:  "",
+					Usage:  "registration or runner authentication `token`",
+					EnvVar: "N1_RUNNER_TOKEN",
+				},
+				cli.StringFlag{
+					Name:  "executor",
+					Value: "shell",
+					Usage: "runner `executor`",
+				},
+				cli.StringFlag{
+					Name:  "description",
+					Value: "",
+					Usage: "runner `description` (default: the host)",
+				},
+				cli.StringFlag{
+					Name:  "tags",
+					Value: "",
+					Usage: "runner `tags`, separated by ','",
+				},
+				cli.BoolFlag{
+					Name:  "run-untagged",
+					Usage: "also pick up jobs without tags",
+				},
+				cli.StringSliceFlag{
+					Name:  "arg",
+					Usage: "extra `argument` for 'register', repeatable",
+				},
+			),
+			runnerActionCommand(unregister, "unregister the runner from gitlab",
+				cli.StringFlag{
+					Name:  "name",
+					Value: "",
+					Usage: "runner `name` to unregister",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "unregister all the runners of the config instead",
+				},
+			),
+			runnerActionCommand(verify, "check that the registered runners are still valid in gitlab",
+				cli.BoolFlag{
+					Name:  "delete",
+					Usage: "remove runners no longer valid from the config",
+				},
+			),
+			runnerActionCommand(runnerAction{name: "restart", change: true, args: service}, "restart the runner service", serviceFlag),
+			runnerActionCommand(runnerAction{name: "status", args: service}, "get the runner service status", serviceFlag),
+		},
+	}
+}
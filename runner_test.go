@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestRunnerOutcome(t *testing.T) {
+	for _, tt := range []struct {
+		action  string
+		out     string
+		status  string
+		ok      bool
+		service string
+	}{
+		{"status", "gitlab-runner: Service is running!", "200 OK", true, "running"},
+		{"status", "Service has stopped", "200 OK", true, "stopped"},
+		{"status", "", "200 OK", false, "unknown"},
+		{"status", "something unexpected", "200 OK", false, "unknown"},
+		{"status", "Service is running", "500 Internal Server Error", false, "running"},
+		{"restart", "", "200 OK", true, ""},
+		{"verify", "Verifying runner... is alive                        runner=abc", "200 OK", true, ""},
+		{"verify", "ERROR: Verifying runner... is removed               runner=abc", "200 OK", false, ""},
+		{"register", "FATAL: failed to register", "200 OK", false, ""},
+		{"status", "", dryRunStatus, true, ""},
+	} {
+		r := &runnerResult{Host: "h1", Action: tt.action}
+		runnerOutcome(r, tt.out, tt.status)
+		if r.Ok != tt.ok || r.Service != tt.service {
+			t.Errorf("%s %q (%s): ok=%v service=%q error=%q, want ok=%v service=%q",
+				tt.action, tt.out, tt.status, r.Ok, r.Service, r.Error, tt.ok, tt.service)
+		}
+	}
+}
+
+func TestRunnerUnregisterNeedsTarget(t *testing.T) {
+	exiter, errWriter := cli.OsExiter, cli.ErrWriter
+	cli.OsExiter, cli.ErrWriter = func(int) {}, ioutil.Discard
+	defer func() { cli.OsExiter, cli.ErrWriter = exiter, errWriter }()
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{}, "No runner selected"},
+		{[]string{"--name", "r1", "--all"}, "not both"},
+	} {
+		app := cli.NewApp()
+		app.Commands = []cli.Command{runnerCommand()}
+		args := append([]string{"n1", "runner", "unregister", "--hosts", "h1"}, tt.args...)
+		if err := app.Run(args); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: expected '%s', got %v", tt.args, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Target selection of a gateway request. Groups and where conditions are resolved
+// against the inventory.
+type serveSelector struct {
+	Hosts  []string `json:"hosts"`
+	Groups []string `json:"groups"`
+	Where  string   `json:"where"`
+	Async  bool     `json:"async"`
+
+	// Answers to the confirmation guards, as --yes and --confirm-count.
+	Yes          bool `json:"yes"`
+	ConfirmCount int  `json:"confirmcount"`
+}
+
+// Json body of gateway exec requests.
+type serveExecRequest struct {
+	serveSelector
+	Cmd         string `json:"cmd"`
+	Interactive bool   `json:"interactive"`
+	Wait        *bool  `json:"wait"`
+	WaitMs      int    `json:"waitms"`
+}
+
+// Per-host result of a gateway job.
+type jobResult struct {
+	Host   string `json:"host"`
+	Ok     bool   `json:"ok"`
+	Status string `json:"status,omitempty"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A fan-out operation run by the gateway.
+type job struct {
+	Id       string      `json:"id"`
+	Op       string      `json:"op"`
+	State    string      `json:"state"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Hosts    []string    `json:"hosts"`
+	Done     int         `json:"done"`
+	Failed   int         `json:"failed"`
+	Results  []jobResult `json:"results"`
+}
+
+type gateway struct {
+	invFile string
+	token   string
+	jobTTL  time.Duration // finished jobs are forgotten after this long
+
+	mu   sync.Mutex
+	seq  int
+	jobs map[string]*job
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	b, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(b)
+}
+
+func writeJsonError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, map[string]string{"error": err.Error()})
+}
+
+// Require 'Authorization: Bearer <token>' on every request.
+func (g *gateway) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		got := strings.TrimPrefix(h, "Bearer ")
+		if got == h || subtle.ConstantTimeCompare([]byte(got), []byte(g.token)) != 1 {
+			writeJsonError(w, http.StatusUnauthorized, fmt.Errorf("Unauthorized."))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Returns a snapshot of a job that is safe to encode while the job runs.
+func (g *gateway) snapshot(j *job) job {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := *j
+	s.Results = append([]jobResult{}, j.Results...)
+	return s
+}
+
+// Drop the jobs that finished more than jobTTL before 'now'. Call with g.mu held.
+func (g *gateway) expireJobs(now time.Time) {
+	for id, j := range g.jobs {
+		if j.Finished != nil && now.Sub(*j.Finished) > g.jobTTL {
+			delete(g.jobs, id)
+		}
+	}
+}
+
+// Start 'fn' against all selected hosts as a new job. Responds with the job id right away
+// for async requests, or with the finished job otherwise. 'done', if not nil, is called
+// once the job finishes (or fails to start). Requests must select hosts or groups, there
+// is no default target, and changes must pass the confirmation guards.
+func (g *gateway) start(w http.ResponseWriter, op string, sel serveSelector, fn func(host string) jobResult, done func()) {
+	if done == nil {
+		done = func() {}
+	}
+
+	if len(sel.Hosts) == 0 && len(sel.Groups) == 0 {
+		done()
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("No hosts or groups selected."))
+		return
+	}
+
+	hosts, err := selectHosts(g.invFile, sel.Hosts, sel.Groups, sel.Where)
+	if err != nil {
+		done()
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if op != "version" {
+		a := guardAnswers{yes: sel.Yes, count: sel.ConfirmCount}
+		if err := checkTargets(op, protectedOps[op], hosts, g.invFile, a); err != nil {
+			done()
+			writeJsonError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	g.mu.Lock()
+	g.seq++
+	j := &job{
+		Id:      strconv.Itoa(g.seq),
+		Op:      op,
+		State:   "running",
+		Started: time.Now(),
+		Hosts:   hosts,
+		Results: make([]jobResult, len(hosts)),
+	}
+
+	g.expireJobs(j.Started)
+	g.jobs[j.Id] = j
+	g.mu.Unlock()
+	infoln("Job", j.Id, op, "started for", strings.Join(hosts, ","))
+
+	finished := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i, host := range hosts {
+			wg.Add(1)
+			go func(i int, host string) {
+				defer wg.Done()
+				res := fn(host)
+				res.Host = host
+				g.mu.Lock()
+				j.Results[i] = res
+				j.Done++
+				if !res.Ok {
+					j.Failed++
+				}
+
+				g.mu.Unlock()
+			}(i, host)
+		}
+
+		wg.Wait()
+		g.mu.Lock()
+		now := time.Now()
+		j.Finished = &now
+		j.State = "done"
+		if j.Failed > 0 {
+			j.State = "failed"
+		}
+
+		g.mu.Unlock()
+		infoln("Job", j.Id, op, j.State)
+		done()
+		close(finished)
+	}()
+
+	if sel.Async {
+		writeJson(w, http.StatusAccepted, map[string]string{"id": j.Id})
+		return
+	}
+
+	<-finished
+	writeJson(w, http.StatusOK, g.snapshot(j))
+}
+
+// Returns a job result from an http call's output.
+func hostResult(body []byte, status string, err error) jobResult {
+	if err != nil {
+		return jobResult{Error: err.Error()}
+	}
+
+	return jobResult{Ok: strings.HasPrefix(status, "200"), Status: status, Output: string(body)}
+}
+
+// Returns an error-only job result.
+func errResult(err error) jobResult {
+	if err != nil {
+		return jobResult{Error: err.Error()}
+	}
+
+	return jobResult{Ok: true}
+}
+
+// Returns the selector of a multipart request from its form fields.
+func formSelector(r *http.Request) serveSelector {
+	count, _ := strconv.Atoi(r.FormValue("confirmcount"))
+	return serveSelector{
+		Hosts:  splitList(r.FormValue("hosts")),
+		Groups: splitList(r.FormValue("groups")),
+		Where:  r.FormValue("where"),
+		Async:  r.FormValue("async") == "true",
+
+		Yes:          r.FormValue("yes") == "true",
+		ConfirmCount: count,
+	}
+}
+
+// Save the 'uploadfile' form file into a temp directory under its original name. Returns
+// the local path; remove its directory when done.
+func saveFormFile(r *http.Request) (string, error) {
+	f, h, err := r.FormFile("uploadfile")
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "n1-serve-")
+	if err != nil {
+		return "", err
+	}
+
+	local := filepath.Join(dir, filepath.Base(h.Filename))
+	out, err := os.Create(local)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	_, err = io.Copy(out, f)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return local, nil
+}
+
+func (g *gateway) handleVersion(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sel := serveSelector{
+		Hosts:  splitList(q.Get("hosts")),
+		Groups: splitList(q.Get("groups")),
+		Where:  q.Get("where"),
+	}
+
+	g.start(w, "version", sel, func(host string) jobResult {
+		return hostResult(httpGetVersion(host))
+	}, nil)
+}
+
+func (g *gateway) handleExec(w http.ResponseWriter, r *http.Request) {
+	var req serveExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Cmd == "" {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("Invalid exec request, 'cmd' required."))
+		return
+	}
+
+	wait := true
+	if req.Wait != nil {
+		wait = *req.Wait
+	}
+
+	g.start(w, "exec", req.serveSelector, func(host string) jobResult {
+		return hostResult(httpExecChange("exec", host, req.Cmd, req.Interactive, wait, req.WaitMs))
+	}, nil)
+}
+
+func (g *gateway) handleUpload(w http.ResponseWriter, r *http.Request) {
+	local, err := saveFormFile(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	path := r.FormValue("path")
+	if path == "" {
+		path = "root"
+	}
+
+	// Async jobs outlive the request, the file is removed once the job finishes.
+	g.start(w, "upload", formSelector(r), func(host string) jobResult {
+		return hostResult(uploadFileAs(host, local, local, path))
+	}, func() { os.RemoveAll(filepath.Dir(local)) })
+}
+
+func (g *gateway) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	what := strings.TrimPrefix(r.URL.Path, "/api/v1/update/")
+	local, err := saveFormFile(r)
+	if err != nil && !(what == "runner" && err == http.ErrMissingFile) {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err != nil {
+		local = ""
+	}
+
+	var fn func(host string) error
+	cleanup := func() {
+		if local != "" {
+			os.RemoveAll(filepath.Dir(local))
+		}
+	}
+
+	switch what {
+	case "self":
+		reboot := r.FormValue("reboot") != "false"
+		fn = func(host string) error { return httpSendUpdateService(host, local, reboot) }
+	case "conf":
+		fn = func(host string) error { return httpSendUpdateConf(host, local) }
+	case "runner":
+		if local == "" {
+			cleanup = nil
+			infoln("Download latest runner to tempdir:", os.TempDir())
+			f, err := downloadRunner(os.TempDir(), "")
+			if err != nil {
+				writeJsonError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			local = os.TempDir() + `\` + f
+		}
+
+		fn = func(host string) error { return updateRunner(host, local, false, 0, 0) }
+	default:
+		cleanup()
+		writeJsonError(w, http.StatusNotFound, fmt.Errorf("Unknown update '%s'.", what))
+		return
+	}
+
+	g.start(w, "update "+what, formSelector(r), func(host string) jobResult {
+		return errResult(fn(host))
+	}, cleanup)
+}
+
+func (g *gateway) handleJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/jobs")
+	id = strings.Trim(id, "/")
+	g.mu.Lock()
+	j, ok := g.jobs[id]
+	all := []*job{}
+	for _, j := range g.jobs {
+		all = append(all, j)
+	}
+
+	g.mu.Unlock()
+	if id != "" {
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, fmt.Errorf("Job '%s' not found.", id))
+			return
+		}
+
+		writeJson(w, http.StatusOK, g.snapshot(j))
+		return
+	}
+
+	list := []job{}
+	for _, j := range all {
+		s := g.snapshot(j)
+		s.Results = nil
+		list = append(list, s)
+	}
+
+	sort.Slice(list, func(a, b int) bool { return list[a].Started.Before(list[b].Started) })
+	writeJson(w, http.StatusOK, list)
+}
+
+// Only allow 'method' for a handler.
+func method(m string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed.", r.Method))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func serveCommand() cli.Command {
+	return cli.Command{
+		Name:  "serve",
+		Usage: "run an authenticated http gateway for fan-out operations",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "listen",
+				Value: ":9120",
+				Usage: "`address` to listen on",
+			},
+			cli.StringFlag{
+				Name:   "token",
+				Value:  "",
+				Usage:  "bearer `token` clients must send",
+				EnvVar: "N1_SERVE_TOKEN",
+			},
+			cli.StringFlag{
+				Name:  "cert",
+				Value: "",
+				Usage: "tls certificate `file` (serve https with --key)",
+			},
+			cli.StringFlag{
+				Name:  "key",
+				Value: "",
+				Usage: "tls key `file`",
+			},
+			cli.DurationFlag{
+				Name:  "job-ttl",
+				Value: time.Hour,
+				Usage: "forget finished jobs after this `duration`",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.String("token") == "" {
+				err := fmt.Errorf("No token provided. See --token flag for more info.")
+				errorln(err)
+				return err
+			}
+
+			g := &gateway{
+				invFile: c.GlobalString("inventory"),
+				token:   c.String("token"),
+				jobTTL:  c.Duration("job-ttl"),
+				jobs:    map[string]*job{},
+			}
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v1/version", g.auth(method("GET", g.handleVersion)))
+			mux.HandleFunc("/api/v1/exec", g.auth(method("POST", g.handleExec)))
+			mux.HandleFunc("/api/v1/upload", g.auth(method("POST", g.handleUpload)))
+			mux.HandleFunc("/api/v1/update/", g.auth(method("POST", g.handleUpdate)))
+			mux.HandleFunc("/api/v1/jobs", g.auth(method("GET", g.handleJobs)))
+			mux.HandleFunc("/api/v1/jobs/", g.auth(method("GET", g.handleJobs)))
+			infoln("Serving on", c.String("listen"))
+			if c.String("cert") != "" {
+				return http.ListenAndServeTLS(c.String("listen"), c.String("cert"), c.String("key"), mux)
+			}
+
+			return http.ListenAndServe(c.String("listen"), mux)
+		},
+	}
+}
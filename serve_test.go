@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGateway() *gateway {
+	return &gateway{invFile: "testdata-missing.yaml", token: "secret", jobTTL: time.Hour, jobs: map[string]*job{}}
+}
+
+func TestGatewayAuth(t *testing.T) {
+	g := newTestGateway()
+	ok := g.auth(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	for header, want := range map[string]int{
+		"Bearer secret": http.StatusOK,
+		"secret":        http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"":              http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("GET", "/api/v1/version", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		ok(w, r)
+		if w.Code != want {
+			t.Errorf("Authorization %q: got %d, want %d", header, w.Code, want)
+		}
+	}
+}
+
+func TestGatewayEmptySelector(t *testing.T) {
+	g := newTestGateway()
+	r := httptest.NewRequest("POST", "/api/v1/exec", strings.NewReader(`{"cmd": "hostname"}`))
+	w := httptest.NewRecorder()
+	g.handleExec(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGatewayUpdateFailedStatus(t *testing.T) {
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		return 500, "update failed"
+	})
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, _ := mw.CreateFormFile("uploadfile", "conf.yaml")
+	fw.Write([]byte("a: 1\n"))
+	mw.WriteField("hosts", "h1,h2")
+	mw.Close()
+
+	g := newTestGateway()
+	r := httptest.NewRequest("POST", "/api/v1/update/conf", &b)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	g.handleUpdate(w, r)
+
+	var j job
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+
+	if j.State != "failed" || j.Failed != 2 {
+		t.Errorf("expected both hosts to fail, got %+v", j)
+	}
+
+	for _, res := range j.Results {
+		if res.Ok || !strings.Contains(res.Error, "500") {
+			t.Errorf("%s: expected a failed result with the status, got %+v", res.Host, res)
+		}
+	}
+}
+
+func TestGatewayExpireJobs(t *testing.T) {
+	g := newTestGateway()
+	now := time.Now()
+	old, recent := now.Add(-2*time.Hour), now.Add(-time.Minute)
+	g.jobs["1"] = &job{Id: "1", State: "done", Finished: &old}
+	g.jobs["2"] = &job{Id: "2", State: "failed", Finished: &recent}
+	g.jobs["3"] = &job{Id: "3", State: "running", Started: old}
+	g.expireJobs(now)
+	if _, ok := g.jobs["1"]; ok {
+		t.Errorf("expected job 1 to expire")
+	}
+
+	if len(g.jobs) != 2 || g.jobs["2"] == nil || g.jobs["3"] == nil {
+		t.Errorf("expected jobs 2 and 3 to stay, got %v", g.jobs)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// File information as returned by holly's filestat endpoint.
+type fileStat struct {
+	Path    string    `json:"path"`
+	Exists  bool      `json:"exists"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	// File version resource of executables; may be empty.
+	Version string `json:"version"`
+	// Hex-encoded sha256 of the file contents; may be empty.
+	Hash string `json:"hash"`
+}
+
+// File stats of a single host.
+type hostStats struct {
+	Host  string     `json:"host"`
+	Stats []fileStat `json:"stats"`
+	Error string     `json:"error,omitempty"`
+}
+
+// Returns the parsed file stats for 'files' in 'host', in the same order.
+func httpFileStats(host string, files []string) ([]fileStat, error) {
+	url := `http://` + host + `:8080/api/v1/filestat`
+	body, status, err := httpOctetStream("GET", url, strings.Join(files, ","))
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	if !strings.HasPrefix(status, "200") {
+		return nil, fmt.Errorf("Filestat failed with status: %s", status)
+	}
+
+	var stats []fileStat
+	err = json.Unmarshal(body, &stats)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Query the file stats of all hosts concurrently. Results are in the order of 'hosts'.
+func fleetFileStats(hosts, files []string) []hostStats {
+	res := make([]hostStats, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			res[i].Host = host
+			stats, err := httpFileStats(host, files)
+			if err != nil {
+				res[i].Error = err.Error()
+				return
+			}
+
+			res[i].Stats = stats
+		}(i, host)
+	}
+
+	wg.Wait()
+	return res
+}
+
+// Compare dotted versions numerically, e.g. "1.10.0" > "1.9". A prerelease (after the
+// first '-') sorts below its release as in semver, e.g. "1.2.3-rc1" < "1.2.3". Returns
+// -1, 0 or 1.
+func compareVersions(a, b string) int {
+	ra, pa := a, ""
+	if i := strings.Index(a, "-"); i >= 0 {
+		ra, pa = a[:i], a[i+1:]
+	}
+
+	rb, pb := b, ""
+	if i := strings.Index(b, "-"); i >= 0 {
+		rb, pb = b[:i], b[i+1:]
+	}
+
+	if c := compareFields(ra, rb); c != 0 {
+		return c
+	}
+
+	switch {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	}
+
+	return compareFields(pa, pb)
+}
+
+// Compare dot-separated fields, numerically when both are numbers and as strings
+// otherwise. Missing fields count as 0.
+func compareFields(a, b string) int {
+	pa := strings.FieldsFunc(a, func(r rune) bool { return r == '.' || r == '-' || r == ' ' })
+	pb := strings.FieldsFunc(b, func(r rune) bool { return r == '.' || r == '-' || r == ' ' })
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var sa, sb string
+		if i < len(pa) {
+			sa = pa[i]
+		}
+
+		if i < len(pb) {
+			sb = pb[i]
+		}
+
+		na, ea := strconv.Atoi(sa)
+		nb, eb := strconv.Atoi(sb)
+		if sa == "" {
+			na, ea = 0, nil
+		}
+
+		if sb == "" {
+			nb, eb = 0, nil
+		}
+
+		switch {
+		case ea == nil && eb == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+
+			return 1
+		case (ea != nil || eb != nil) && sa != sb:
+			if sa < sb {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Returns true if 'c' (-1, 0 or 1) satisfies the comparison operator 'op'.
+func cmpOk(op string, c int) bool {
+	switch op {
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "!=":
+		return c != 0
+	}
+
+	return c == 0
+}
+
+var reAssert = regexp.MustCompile(`^\s*(!?exists|missing|size|version|hash)\s*(>=|<=|==|!=|>|<|=)?\s*(.*?)\s*$`)
+
+// A parsed --assert expression, e.g. "exists", "size>1024" or "version>=1.2".
+type statAssert struct {
+	expr  string
+	field string
+	op    string
+	value string
+}
+
+func parseStatAssert(expr string) (statAssert, error) {
+	m := reAssert.FindStringSubmatch(expr)
+	if m == nil {
+		return statAssert{}, fmt.Errorf("Invalid assertion '%s'.", expr)
+	}
+
+	a := statAssert{expr: expr, field: m[1], op: m[2], value: m[3]}
+	switch a.field {
+	case "exists", "!exists", "missing":
+		if a.op != "" || a.value != "" {
+			return a, fmt.Errorf("Invalid assertion '%s'.", expr)
+		}
+	case "size":
+		if _, err := strconv.ParseInt(a.value, 10, 64); err != nil || a.op == "" {
+			return a, fmt.Errorf("Invalid assertion '%s'.", expr)
+		}
+	case "hash":
+		if (a.op != "=" && a.op != "==" && a.op != "!=") || a.value == "" {
+			return a, fmt.Errorf("Invalid assertion '%s', hashes only compare with = or !=.", expr)
+		}
+	default:
+		if a.op == "" || a.value == "" {
+			return a, fmt.Errorf("Invalid assertion '%s'.", expr)
+		}
+	}
+
+	return a, nil
+}
+
+// Returns true if the file stat satisfies the assertion.
+func (a statAssert) check(st fileStat) bool {
+	switch a.field {
+	case "exists":
+		return st.Exists
+	case "!exists", "missing":
+		return !st.Exists
+	case "size":
+		n, _ := strconv.ParseInt(a.value, 10, 64)
+		c := 0
+		if st.Size < n {
+			c = -1
+		} else if st.Size > n {
+			c = 1
+		}
+
+		return st.Exists && cmpOk(a.op, c)
+	case "version":
+		return st.Exists && st.Version != "" && cmpOk(a.op, compareVersions(st.Version, a.value))
+	case "hash":
+		c := 1
+		if strings.EqualFold(st.Hash, a.value) {
+			c = 0
+		}
+
+		return st.Exists && cmpOk(a.op, c)
+	}
+
+	return false
+}
+
+// Returns a comparable signature of a file's content for --compare.
+func statSignature(st fileStat) string {
+	if !st.Exists {
+		return "missing"
+	}
+
+	if st.Hash != "" {
+		return fmt.Sprintf("size=%d hash=%.12s", st.Size, st.Hash)
+	}
+
+	return fmt.Sprintf("size=%d version=%s mtime=%s", st.Size, st.Version, st.ModTime.UTC().Format(time.RFC3339))
+}
+
+// Returns a description of the hosts whose files differ from the majority, one per line.
+func compareStats(results []hostStats, files []string) []string {
+	diffs := []string{}
+	for i, f := range files {
+		count := map[string]int{}
+		for _, r := range results {
+			if i < len(r.Stats) {
+				count[statSignature(r.Stats[i])]++
+			}
+		}
+
+		majority, best := "", 0
+		for sig, n := range count {
+			if n > best || (n == best && sig < majority) {
+				majority, best = sig, n
+			}
+		}
+
+		for _, r := range results {
+			if i >= len(r.Stats) {
+				continue
+			}
+
+			if sig := statSignature(r.Stats[i]); sig != majority {
+				diffs = append(diffs, fmt.Sprintf("%s: %s: %s (majority: %s)", r.Host, f, sig, majority))
+			}
+		}
+	}
+
+	sort.Strings(diffs)
+	return diffs
+}
+
+func printStats(results []hostStats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tPATH\tEXISTS\tSIZE\tMODE\tMTIME\tVERSION\tHASH")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t%s\n", r.Host, r.Error)
+			continue
+		}
+
+		for _, st := range r.Stats {
+			mtime := "-"
+			if !st.ModTime.IsZero() {
+				mtime = st.ModTime.Local().Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\t%s\t%s\t%.12s\n", r.Host, st.Path, st.Exists, st.Size, st.Mode, mtime, st.Version, st.Hash)
+		}
+	}
+
+	w.Flush()
+}
+
+// Query, print and check the file stats of all hosts. Returns an error if any host failed,
+// any assertion failed, or (with 'compare') any host differs from the majority.
+func statFiles(hosts, files, asserts []string, compare bool, outFile string) error {
+	checks := []statAssert{}
+	for _, expr := range asserts {
+		a, err := parseStatAssert(expr)
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		checks = append(checks, a)
+	}
+
+	results := fleetFileStats(hosts, files)
+	printStats(results)
+	if outFile != "" {
+		b, _ := json.MarshalIndent(results, "", "  ")
+		err := ioutil.WriteFile(outFile, b, 0644)
+		if err != nil {
+			errorln(err)
+			return err
+		}
+	}
+
+	problems := 0
+	for _, r := range results {
+		if r.Error != "" {
+			withHost(r.Host).errorln(r.Error)
+			problems++
+			continue
+		}
+
+		for _, st := range r.Stats {
+			for _, a := range checks {
+				if !a.check(st) {
+					withHost(r.Host).warnln(st.Path, "assertion failed:", a.expr)
+					problems++
+				}
+			}
+		}
+	}
+
+	if compare {
+		for _, d := range compareStats(results, files) {
+			warnln("Differs:", d)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("Stat found %d problem(s).", problems)
+	}
+
+	return nil
+}
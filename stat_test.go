@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.10", "1.9", 1},
+		{"1.9", "1.10", -1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.2.3-beta", "1.2.3-alpha", 1},
+		{"1.2.3", "1.2.3-rc1", 1},
+		{"1.2.3-rc1", "1.2.3", -1},
+		{"1.2.3-rc.2", "1.2.3-rc.10", -1},
+		{"1.2.4-rc1", "1.2.3", 1},
+		{"1.2-rc1", "1.2.0-rc1", 0},
+		{"v1", "v1", 0},
+		{"", "0", 0},
+	} {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseStatAssert(t *testing.T) {
+	for _, expr := range []string{"exists>1", "size", "size>big", "version>=", "hash", "mtime>1", "exists 1", "hash>abc", "hash<=abc", "hash="} {
+		if _, err := parseStatAssert(expr); err == nil {
+			t.Errorf("parseStatAssert(%q): expected an error", expr)
+		}
+	}
+
+	st := fileStat{Exists: true, Size: 2048, Version: "1.10.2", Hash: "ABCDEF"}
+	for _, tt := range []struct {
+		expr string
+		st   fileStat
+		want bool
+	}{
+		{"exists", st, true},
+		{"!exists", st, false},
+		{"missing", fileStat{}, true},
+		{"size>1024", st, true},
+		{"size <= 1024", st, false},
+		{"size=2048", st, true},
+		{"size<1", fileStat{}, false},
+		{"version>=1.9", st, true},
+		{"version<1.10.10", st, true},
+		{"version==1.10.2", st, true},
+		{"version!=1.10.2", st, false},
+		{"version>0", fileStat{Exists: true}, false},
+		{"hash=abcdef", st, true},
+		{"hash!=abcdef", st, false},
+	} {
+		a, err := parseStatAssert(tt.expr)
+		if err != nil {
+			t.Errorf("parseStatAssert(%q): %v", tt.expr, err)
+			continue
+		}
+
+		if got := a.check(tt.st); got != tt.want {
+			t.Errorf("%q on %+v = %v, want %v", tt.expr, tt.st, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+type syncOptions struct {
+	include []string
+	exclude []string
+	delete  bool
+	dryRun  bool
+}
+
+// A local file to be synced.
+type syncFile struct {
+	// Slash-separated path relative to the local directory.
+	rel   string
+	local string
+	size  int64
+	mtime time.Time
+}
+
+// Returns true if 'rel' (or its base name) matches any of the glob patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if 'rel' passes the include/exclude filters.
+func (o *syncOptions) selected(rel string) bool {
+	if len(o.include) > 0 && !matchAny(o.include, rel) {
+		return false
+	}
+
+	return !matchAny(o.exclude, rel)
+}
+
+// Returns the filtered list of regular files under 'dir'.
+func localTree(dir string, o *syncOptions) ([]syncFile, error) {
+	files := []syncFile{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		if o.selected(rel) {
+			files = append(files, syncFile{rel: rel, local: p, size: fi.Size(), mtime: fi.ModTime()})
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// Returns the hex-encoded sha256 of a local file.
+func fileHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Convert a slash-separated relative path to a remote path under 'dir'.
+func remotePath(shell, dir, rel string) string {
+	if shell == "cmd" {
+		rel = strings.Replace(rel, "/", `\`, -1)
+	}
+
+	return remoteJoin(shell, dir, rel)
+}
+
+// Returns the slash-separated relative paths of all files under the remote 'dir'. Windows
+// paths are compared with backslashes and ignoring case, so 'c:/dir' works too.
+func remoteTree(host, shell, dir string) ([]string, error) {
+	norm := func(p string) string { return p }
+	if shell == "cmd" {
+		norm = func(p string) string { return strings.ToLower(strings.Replace(p, "/", `\`, -1)) }
+		dir = strings.Replace(dir, "/", `\`, -1)
+	}
+
+	cmd := `cmd /c dir /s /b /a-d ` + quoteArg("cmd", dir)
+	if shell == "sh" {
+		cmd = `find ` + quoteArg("sh", dir) + ` -type f`
+	}
+
+	body, status, err := httpExec(host, cmd, false, true, 0)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	if !strings.HasPrefix(status, "200") {
+		return nil, fmt.Errorf("Listing %s failed with status: %s", dir, status)
+	}
+
+	prefix := norm(remoteJoin(shell, dir, ""))
+	files := []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) <= len(prefix) || norm(line[:len(prefix)]) != prefix {
+			continue
+		}
+
+		files = append(files, strings.Replace(line[len(prefix):], `\`, "/", -1))
+	}
+
+	return files, nil
+}
+
+// Returns the reason a local file needs to be uploaded, or "" if the remote copy matches.
+func syncReason(f syncFile, st fileStat) (string, error) {
+	if !st.Exists {
+		return "missing", nil
+	}
+
+	if st.Size != f.size {
+		return "size", nil
+	}
+
+	if st.Hash != "" {
+		h, err := fileHash(f.local)
+		if err != nil {
+			return "", err
+		}
+
+		if !strings.EqualFold(h, st.Hash) {
+			return "hash", nil
+		}
+
+		return "", nil
+	}
+
+	if st.ModTime.Before(f.mtime) {
+		return "mtime", nil
+	}
+
+	return "", nil
+}
+
+// Make the remote directory 'remote' in 'host' match the local 'dir'.
+func syncHost(host, dir, remote string, o *syncOptions) error {
+	if host == "" {
+		err := fmt.Errorf("No host/ip provided. See --hosts flag for more info.")
+		errorln(err)
+		return err
+	}
+
+	shell := remoteShell(remote)
+	files, err := localTree(dir, o)
+	if err != nil {
+		errorln(err)
+		return err
+	}
+
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = remotePath(shell, remote, f.rel)
+	}
+
+	stats := []fileStat{}
+	if len(paths) > 0 {
+		stats, err = httpFileStats(host, paths)
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		if len(stats) != len(paths) {
+			return fmt.Errorf("Expected %d file stats from %s, got %d.", len(paths), host, len(stats))
+		}
+	}
+
+	failed := 0
+	uploads, skipped := 0, 0
+	for i, f := range files {
+		reason, err := syncReason(f, stats[i])
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		if reason == "" {
+			skipped++
+			continue
+		}
+
+		uploads++
+		withHost(host).infoln("upload", f.rel, "("+reason+")")
+		if o.dryRun {
+			continue
+		}
+
+		rdir := remote
+		if d := path.Dir(f.rel); d != "." {
+			rdir = remotePath(shell, remote, d)
+		}
+
+		_, status, err := uploadFileAs(host, f.local, path.Base(f.rel), rdir)
+		if err != nil || !strings.HasPrefix(status, "200") {
+			withHost(host).errorln("upload", f.rel, "failed:", status, err)
+			failed++
+		}
+	}
+
+	deletes := 0
+	if o.delete {
+		remoteFiles, err := remoteTree(host, shell, remote)
+		if err != nil {
+			errorln(err)
+			return err
+		}
+
+		local := map[string]bool{}
+		for _, f := range files {
+			local[strings.ToLower(f.rel)] = true
+		}
+
+		sort.Strings(remoteFiles)
+		for _, rel := range remoteFiles {
+			if local[strings.ToLower(rel)] || !o.selected(rel) {
+				continue
+			}
+
+			deletes++
+			withHost(host).infoln("delete", rel)
+			if o.dryRun {
+				continue
+			}
+
+			cmd := remoteRemoveCmd(shell, remotePath(shell, remote, rel))
+			_, status, err := httpExecChange("sync-delete", host, cmd, false, true, 0)
+			if err != nil || !strings.HasPrefix(status, "200") {
+				withHost(host).errorln("delete", rel, "failed:", status, err)
+				failed++
+			}
+		}
+	}
+
+	withHost(host).infoln(fmt.Sprintf("%d to upload, %d unchanged, %d to delete", uploads, skipped, deletes))
+	if failed > 0 {
+		return fmt.Errorf("%d operation(s) failed in %s.", failed, host)
+	}
+
+	return nil
+}
+
+// Split a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+func syncCommand() cli.Command {
+	return cli.Command{
+		Name:  "sync",
+		Usage: "upload only the changed files of a local directory to a remote path",
+		Flags: append(hostsFlags(),
+			cli.StringFlag{
+				Name:  "include",
+				Value: "",
+				Usage: "comma-separated `globs` of files to sync (default: all)",
+			},
+			cli.StringFlag{
+				Name:  "exclude",
+				Value: "",
+				Usage: "comma-separated `globs` of files to skip",
+			},
+			cli.BoolFlag{
+				Name:  "delete",
+				Usage: "delete remote files that don't exist locally (see the global --dry-run)",
+			},
+		),
+		ArgsUsage: "<localdir> <remotepath>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 2 {
+				errorln("Local directory and remote path required.")
+				return fmt.Errorf("Local directory and remote path required.")
+			}
+
+			dir := c.Args().Get(0)
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				err := fmt.Errorf("Invalid local directory '%s'.", dir)
+				errorln(err)
+				return err
+			}
+
+			o := &syncOptions{
+				include: splitList(c.String("include")),
+				exclude: splitList(c.String("exclude")),
+				delete:  c.Bool("delete"),
+				dryRun:  settings.dryRun,
+			}
+
+			failed := []string{}
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			if !o.dryRun {
+				if err := confirmTargets("sync", hosts); err != nil {
+					errorln(err)
+					return err
+				}
+			}
+
+			for _, host := range hosts {
+				infoln("Start sync request for " + host + ".")
+				if err := syncHost(host, dir, c.Args().Get(1), o); err != nil {
+					failed = append(failed, host)
+				}
+			}
+
+			if len(failed) > 0 {
+				return fmt.Errorf("Sync failed on: %s", strings.Join(failed, ","))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchAny(t *testing.T) {
+	for _, tt := range []struct {
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{[]string{"*.go"}, "main.go", true},
+		{[]string{"*.go"}, "cmd/main.go", true},
+		{[]string{"cmd/*.go"}, "cmd/main.go", true},
+		{[]string{"cmd/*.go"}, "main.go", false},
+		{[]string{"*.txt", "*.md"}, "docs/README.md", true},
+		{[]string{"docs"}, "docs/README.md", false},
+		{nil, "main.go", false},
+	} {
+		if got := matchAny(tt.patterns, tt.rel); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.patterns, tt.rel, got, tt.want)
+		}
+	}
+
+	o := &syncOptions{include: []string{"*.go"}, exclude: []string{"*_test.go"}}
+	for rel, want := range map[string]bool{"main.go": true, "main_test.go": false, "README.md": false} {
+		if got := o.selected(rel); got != want {
+			t.Errorf("selected(%q) = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestSyncReason(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "a.txt")
+	if err := ioutil.WriteFile(local, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := fileHash(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	f := syncFile{rel: "a.txt", local: local, size: 5, mtime: now}
+	for _, tt := range []struct {
+		name string
+		st   fileStat
+		want string
+	}{
+		{"missing", fileStat{}, "missing"},
+		{"size", fileStat{Exists: true, Size: 4, Hash: hash}, "size"},
+		{"same hash", fileStat{Exists: true, Size: 5, Hash: strings.ToUpper(hash), ModTime: now.Add(-time.Hour)}, ""},
+		{"other hash", fileStat{Exists: true, Size: 5, Hash: strings.Repeat("0", 64)}, "hash"},
+		{"older without hash", fileStat{Exists: true, Size: 5, ModTime: now.Add(-time.Hour)}, "mtime"},
+		{"newer without hash", fileStat{Exists: true, Size: 5, ModTime: now.Add(time.Hour)}, ""},
+	} {
+		got, err := syncReason(f, tt.st)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: syncReason = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	f.local = filepath.Join(t.TempDir(), "gone.txt")
+	if _, err := syncReason(f, fileStat{Exists: true, Size: 5, Hash: hash}); err == nil {
+		t.Errorf("expected an error hashing a missing local file")
+	}
+}
+
+func TestRemoteTreeWindowsSlashes(t *testing.T) {
+	withFakeHolly(t, func(r *http.Request, body string) (int, string) {
+		if !strings.Contains(body, `c:\Data\app`) {
+			t.Errorf("expected a backslash path in the listing command, got %q", body)
+		}
+
+		return 200, "C:\\data\\APP\\a.txt\r\nC:\\data\\APP\\sub\\b.txt\r\nC:\\other\\c.txt\r\n"
+	})
+
+	for _, dir := range []string{"c:/Data/app", `c:\Data\app\`, "c:/Data/app/"} {
+		files, err := remoteTree("h1", "cmd", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.Join(files, ","); got != "a.txt,sub/b.txt" {
+			t.Errorf("%s: got %q", dir, got)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A local file and its remote destination directory (the file keeps its name).
+type uploadItem struct {
+	Src  string `yaml:"src"`
+	Dest string `yaml:"dest"`
+}
+
+// Per-file upload result.
+type uploadResult struct {
+	host   string
+	item   uploadItem
+	status string
+	err    error
+}
+
+// Returns true if the ':' at index 'i' is part of a Windows drive letter: a single letter
+// starting the string or following the separator, then ":\". Forward slashes don't count,
+// so "a:/x" is src "a" and dest "/x"; write local Windows paths with backslashes.
+func isDriveColon(s string, i int) bool {
+	if i < 1 || i+1 >= len(s) || s[i+1] != '\\' {
+		return false
+	}
+
+	c := s[i-1]
+	letter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	return letter && (i == 1 || s[i-2] == ':')
+}
+
+// Split a "src:dest" pair. Dest is set to 'def' when not provided or empty ("src:"). Dest
+// is always a directory: holly keeps the source file name, so files can't be renamed on
+// upload.
+func splitUploadPair(s, def string) uploadItem {
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' && !isDriveColon(s, i) {
+			if s[i+1:] == "" {
+				return uploadItem{Src: s[:i], Dest: def}
+			}
+
+			return uploadItem{Src: s[:i], Dest: s[i+1:]}
+		}
+	}
+
+	return uploadItem{Src: s, Dest: def}
+}
+
+// Load a manifest file, a yaml list of src/dest pairs.
+func loadUploadManifest(file, def string) ([]uploadItem, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	var items []uploadItem
+	err = yaml.UnmarshalStrict(b, &items)
+	if err != nil {
+		errorln(err)
+		return nil, err
+	}
+
+	for i := range items {
+		if items[i].Dest == "" {
+			items[i].Dest = def
+		}
+	}
+
+	return items, nil
+}
+
+// Expand glob patterns in the source of each item. Non-glob sources are kept as is.
+func expandUploadItems(items []uploadItem) ([]uploadItem, error) {
+	out := []uploadItem{}
+	for _, item := range items {
+		if !strings.ContainsAny(item.Src, "*?[") {
+			out = append(out, item)
+			continue
+		}
+
+		matches, err := filepath.Glob(item.Src)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No match for '%s'.", item.Src)
+		}
+
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+				continue
+			}
+
+			out = append(out, uploadItem{Src: m, Dest: item.Dest})
+		}
+	}
+
+	return out, nil
+}
+
+// Upload all items to every host. Hosts are processed concurrently.
+func uploadFiles(hosts []string, items []uploadItem) []uploadResult {
+	results := make([][]uploadResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			for _, item := range items {
+				infoln("Start uploading " + item.Src + " to " + host + ":" + item.Dest + ".")
+				_, status, err := uploadFileAs(host, item.Src, item.Src, item.Dest)
+				if err == nil && !strings.HasPrefix(status, "200") {
+					err = fmt.Errorf("Upload failed with status: %s", status)
+				}
+
+				results[i] = append(results[i], uploadResult{host, item, status, err})
+			}
+		}(i, host)
+	}
+
+	wg.Wait()
+	all := []uploadResult{}
+	for _, r := range results {
+		all = append(all, r...)
+	}
+
+	return all
+}
+
+func printUploadResults(results []uploadResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tFILE\tDEST\tSTATUS")
+	for _, r := range results {
+		status := r.status
+		if r.err != nil {
+			status = r.err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.host, r.item.Src, r.item.Dest, status)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestSplitUploadPair(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uploadItem
+	}{
+		{"a.txt", uploadItem{"a.txt", "root"}},
+		{"a.txt:c:\\dest", uploadItem{"a.txt", "c:\\dest"}},
+		{"c:\\src\\a.txt", uploadItem{"c:\\src\\a.txt", "root"}},
+		{"c:\\src\\a.txt:d:\\dest", uploadItem{"c:\\src\\a.txt", "d:\\dest"}},
+		{"a:/x", uploadItem{"a", "/x"}},
+		{"build/*.dll:/opt/app", uploadItem{"build/*.dll", "/opt/app"}},
+		{"a.txt:", uploadItem{"a.txt", "root"}},
+		{"c:\\src\\a.txt:", uploadItem{"c:\\src\\a.txt", "root"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitUploadPair(tt.in, "root"); got != tt.want {
+			t.Errorf("splitUploadPair(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
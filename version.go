@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+)
+
+// Version information of a single host.
+type hostVersion struct {
+	Host      string `json:"host"`
+	Reachable bool   `json:"reachable"`
+	Holly     string `json:"holly"`
+	Runner    string `json:"runner"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Query holly (and optionally runner) versions of all hosts concurrently. Results are in
+// the order of 'hosts'.
+func fleetVersions(hosts []string, runner string) []hostVersion {
+	res := make([]hostVersion, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			res[i].Host = host
+			body, status, err := httpGetVersion(host)
+			if err != nil {
+				res[i].Error = err.Error()
+				return
+			}
+
+			res[i].Reachable = true
+			if !strings.HasPrefix(status, "200") {
+				res[i].Error = status
+				return
+			}
+
+			res[i].Holly = strings.TrimSpace(string(body))
+			if runner == "" {
+				return
+			}
+
+			rv, err := remoteRunnerVersion(host, runner)
+			if err != nil {
+				res[i].Error = err.Error()
+				return
+			}
+
+			res[i].Runner = rv
+		}(i, host)
+	}
+
+	wg.Wait()
+	return res
+}
+
+func printVersions(res []hostVersion) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tREACHABLE\tHOLLY\tRUNNER\tERROR")
+	for _, v := range res {
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\n", v.Host, v.Reachable, v.Holly, v.Runner, v.Error)
+	}
+
+	w.Flush()
+
+	// Summary of hosts per holly version.
+	count := map[string]int{}
+	for _, v := range res {
+		k := v.Holly
+		if !v.Reachable {
+			k = "unreachable"
+		} else if k == "" {
+			k = "unknown"
+		}
+
+		count[k]++
+	}
+
+	keys := []string{}
+	for k := range count {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	fmt.Println()
+	for _, k := range keys {
+		fmt.Printf("%s: %d host(s)\n", k, count[k])
+	}
+}
+
+func versionCommand() cli.Command {
+	return cli.Command{
+		Name:  "version",
+		Usage: "get 'holly' version",
+		Flags: append(hostsFlags(),
+			cli.StringFlag{
+				Name:  "expect",
+				Value: "",
+				Usage: "exit non-zero if any host doesn't run holly `version`",
+			},
+			cli.StringFlag{
+				Name:  "runner",
+				Value: runnerPath,
+				Usage: "runner binary `path` in the hosts, empty to skip the runner version",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			res := fleetVersions(hosts, c.String("runner"))
+			printVersions(res)
+			if !c.IsSet("expect") {
+				return nil
+			}
+
+			bad := []string{}
+			for _, v := range res {
+				if v.Holly != c.String("expect") {
+					bad = append(bad, v.Host)
+				}
+			}
+
+			if len(bad) > 0 {
+				return fmt.Errorf("Expected version %s, differs on: %s", c.String("expect"), strings.Join(bad, ","))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Host states reported by watch.
+const (
+	stateUp      = "up"
+	stateDown    = "down"
+	stateFailing = "failing"
+)
+
+// Current watch status of a host.
+type watchStatus struct {
+	Host    string    `json:"host"`
+	State   string    `json:"state"`
+	Version string    `json:"version"`
+	Detail  string    `json:"detail,omitempty"`
+	Since   time.Time `json:"since"`
+	Checked time.Time `json:"checked"`
+}
+
+// A recorded state change, also the payload sent to the webhook.
+type watchTransition struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Detail   string    `json:"detail,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+type watcher struct {
+	hosts   []string
+	files   []string
+	checks  []statAssert
+	hookCmd string
+	hookUrl string
+	logFile string
+
+	// Hooks run in the background and are killed after this long.
+	hookTimeout time.Duration
+
+	// Hosts not answering a probe within this long are down.
+	probeTimeout time.Duration
+
+	mu     sync.Mutex
+	status map[string]*watchStatus
+}
+
+// Probe a single host: version endpoint first, then the optional file checks.
+func (w *watcher) probe(host string) (state, version, detail string) {
+	body, status, err := httpGetVersion(host)
+	if err != nil {
+		return stateDown, "", err.Error()
+	}
+
+	if !strings.HasPrefix(status, "200") {
+		return stateDown, "", status
+	}
+
+	version = strings.TrimSpace(string(body))
+	if len(w.files) == 0 {
+		return stateUp, version, ""
+	}
+
+	stats, err := httpFileStats(host, w.files)
+	if err != nil {
+		return stateFailing, version, err.Error()
+	}
+
+	failed := []string{}
+	for _, st := range stats {
+		for _, a := range w.checks {
+			if !a.check(st) {
+				failed = append(failed, st.Path+": "+a.expr)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return stateFailing, version, strings.Join(failed, "; ")
+	}
+
+	return stateUp, version, ""
+}
+
+// Probe all hosts concurrently and record state changes. A probe taking longer than the
+// probe timeout marks the host down, so one hung host never stalls the others.
+func (w *watcher) poll() []watchTransition {
+	now := time.Now()
+	changes := []watchTransition{}
+	var wg sync.WaitGroup
+	for _, host := range w.hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			type probe struct{ state, version, detail string }
+			done := make(chan probe, 1)
+			go func() {
+				state, version, detail := w.probe(host)
+				done <- probe{state, version, detail}
+			}()
+
+			var p probe
+			select {
+			case p = <-done:
+			case <-time.After(w.probeTimeout):
+				p = probe{state: stateDown, detail: fmt.Sprintf("probe timed out after %v", w.probeTimeout)}
+			}
+
+			state, version, detail := p.state, p.version, p.detail
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			st, ok := w.status[host]
+			if !ok {
+				st = &watchStatus{Host: host, Since: now}
+				w.status[host] = st
+			}
+
+			if ok && st.State != state {
+				changes = append(changes, watchTransition{
+					Time:     now,
+					Host:     host,
+					From:     st.State,
+					To:       state,
+					Detail:   detail,
+					Duration: now.Sub(st.Since).Round(time.Second).String(),
+				})
+
+				st.Since = now
+			}
+
+			st.State, st.Version, st.Detail, st.Checked = state, version, detail, now
+		}(host)
+	}
+
+	wg.Wait()
+	return changes
+}
+
+func (w *watcher) render(recent []watchTransition) {
+	if isTerminal(os.Stdout) {
+		fmt.Print("\033[H\033[2J")
+	}
+
+	fmt.Println("n1 watch:", time.Now().Format("2006-01-02 15:04:05"))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTATE\tVERSION\tSINCE\tDETAIL")
+	w.mu.Lock()
+	for _, host := range w.hosts {
+		st := w.status[host]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", st.Host, st.State, st.Version, st.Since.Format("15:04:05"), st.Detail)
+	}
+
+	w.mu.Unlock()
+	tw.Flush()
+	if len(recent) > 0 {
+		fmt.Println("\nRecent transitions:")
+		for _, t := range recent {
+			fmt.Printf("%s %s: %s -> %s (after %s)\n", t.Time.Format("15:04:05"), t.Host, t.From, t.To, t.Duration)
+		}
+	}
+}
+
+// Record a transition to the log file and start the hooks, so slow hooks never delay
+// the next poll.
+func (w *watcher) notify(t watchTransition) {
+	withHost(t.Host).infoln(t.From, "->", t.To, t.Detail)
+	b, _ := json.Marshal(t)
+	if w.logFile != "" {
+		f, err := os.OpenFile(w.logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Write(append(b, '\n'))
+			f.Close()
+		} else {
+			errorln(err)
+		}
+	}
+
+	go w.runHooks(t, b)
+}
+
+// Run the hook command and webhook for transition 't' with json payload 'b'.
+func (w *watcher) runHooks(t watchTransition, b []byte) {
+	if w.hookCmd != "" {
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/c"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), w.hookTimeout)
+		cmd := exec.CommandContext(ctx, shell, flag, w.hookCmd)
+		cmd.Env = append(os.Environ(), "N1_HOST="+t.Host, "N1_STATE="+t.To, "N1_PREVIOUS_STATE="+t.From, "N1_DETAIL="+t.Detail)
+		// Don't wait for the output of children left behind by a killed shell.
+		cmd.WaitDelay = time.Second
+		if out, err := cmd.CombinedOutput(); err != nil {
+			warnln("Hook command failed:", err, string(out))
+		}
+
+		cancel()
+	}
+
+	if w.hookUrl != "" {
+		client := &http.Client{Timeout: w.hookTimeout}
+		resp, err := client.Post(w.hookUrl, "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			warnln("Webhook failed:", err)
+			return
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			warnln("Webhook failed with status:", resp.Status)
+		}
+	}
+}
+
+func watchCommand() cli.Command {
+	return cli.Command{
+		Name:  "watch",
+		Usage: "continuously monitor host(s) and run hooks on state changes",
+		Flags: append(hostsFlags(),
+			cli.DurationFlag{
+				Name:  "interval",
+				Value: 30 * time.Second,
+				Usage: "poll `interval`",
+			},
+			cli.StringFlag{
+				Name:  "files",
+				Value: "",
+				Usage: "comma-separated file list to check on every poll",
+			},
+			cli.StringSliceFlag{
+				Name:  "assert",
+				Usage: "file `check` (see stat), failing checks mark the host as failing",
+			},
+			cli.StringFlag{
+				Name:  "hook-cmd",
+				Value: "",
+				Usage: "local `command` to run on state changes (N1_HOST, N1_STATE, N1_PREVIOUS_STATE set)",
+			},
+			cli.StringFlag{
+				Name:  "hook-url",
+				Value: "",
+				Usage: "webhook `url` to POST state changes to as json",
+			},
+			cli.DurationFlag{
+				Name:  "probe-timeout",
+				Value: 20 * time.Second,
+				Usage: "mark hosts down when a probe takes longer than `duration`",
+			},
+			cli.DurationFlag{
+				Name:  "hook-timeout",
+				Value: 30 * time.Second,
+				Usage: "kill hook commands and give up on webhooks after `duration`",
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "",
+				Usage: "append state changes as json lines to `file`",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			hosts, err := resolveHosts(c)
+			if err != nil {
+				errorln(err)
+				return err
+			}
+
+			w := &watcher{
+				hosts:   hosts,
+				files:   splitList(c.String("files")),
+				hookCmd: c.String("hook-cmd"),
+				hookUrl: c.String("hook-url"),
+				logFile: c.String("log"),
+				status:  map[string]*watchStatus{},
+
+				hookTimeout:  c.Duration("hook-timeout"),
+				probeTimeout: c.Duration("probe-timeout"),
+			}
+
+			asserts := c.StringSlice("assert")
+			if len(w.files) > 0 && len(asserts) == 0 {
+				asserts = []string{"exists"}
+			}
+
+			for _, expr := range asserts {
+				a, err := parseStatAssert(expr)
+				if err != nil {
+					errorln(err)
+					return err
+				}
+
+				w.checks = append(w.checks, a)
+			}
+
+			recent := []watchTransition{}
+			for {
+				for _, t := range w.poll() {
+					w.notify(t)
+					recent = append(recent, t)
+				}
+
+				if len(recent) > 10 {
+					recent = recent[len(recent)-10:]
+				}
+
+				w.render(recent)
+				time.Sleep(c.Duration("interval"))
+			}
+		},
+	}
+}
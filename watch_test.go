@@ -0,0 +1,27 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWatchSlowHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook command uses sh")
+	}
+
+	w := &watcher{hookCmd: "sleep 5", hookTimeout: 200 * time.Millisecond}
+	tr := watchTransition{Host: "h1", From: stateUp, To: stateDown}
+	start := time.Now()
+	w.notify(tr)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("notify blocked for %v", d)
+	}
+
+	start = time.Now()
+	w.runHooks(tr, nil)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("hook not killed after its timeout, ran %v", d)
+	}
+}